@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcrypt ignores everything after the 72nd byte of a password.
+const maxPasswordBytes = 72
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username must be 3-32 characters of letters, digits, '.', '_' or '-' and start with a letter or digit")
+	}
+	return nil
+}
+
+type PasswordPolicy struct {
+	MinLength      int
+	RequireLetter  bool
+	RequireDigit   bool
+	RequireSpecial bool
+}
+
+// Validate checks password against the policy. The username is needed to
+// reject passwords that contain it.
+func (p PasswordPolicy) Validate(username string, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes long", maxPasswordBytes)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+
+	var hasLetter, hasDigit, hasSpecial bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			hasLetter = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case !unicode.IsSpace(c):
+			hasSpecial = true
+		}
+	}
+	if p.RequireLetter && !hasLetter {
+		return errors.New("password must contain a letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		return errors.New("password must contain a digit")
+	}
+	if p.RequireSpecial && !hasSpecial {
+		return errors.New("password must contain a special character")
+	}
+	return nil
+}
+
+// confirmPassword checks the password a logged-in user entered to confirm
+// an account change. Failures count towards the user's and the client IP's
+// login lockouts, so that a stolen session cannot be used to guess the
+// password either. On failure it has already written the error response
+// and returns false.
+func confirmPassword(w http.ResponseWriter, r *http.Request, guard *loginGuard, user User, password string) bool {
+	ip := clientIP(r)
+	if wait := guard.RetryAfter(user.login, ip, time.Now()); wait > 0 {
+		audit(r, "login_throttled", "username", user.login)
+		setRetryAfter(w, wait)
+		writeError(w, r, http.StatusTooManyRequests, "login_locked", "Too many failed login attempts")
+		return false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.hash), []byte(password)) != nil {
+		audit(r, "login_failed", "username", user.login, "reason", "bad_password")
+		if lockout := guard.Fail(user.login, ip, time.Now()); lockout > 0 {
+			audit(r, "login_locked", "username", user.login, "duration", lockout.String())
+		}
+		writeError(w, r, http.StatusUnauthorized, "invalid_password", "Invalid password")
+		return false
+	}
+	guard.Succeed(user.login)
+	return true
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" example:"securePassword123"`
+	NewPassword     string `json:"new_password" example:"evenMoreSecure456"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" example:"securePassword123"`
+}
+
+// @Summary Change password
+// @Description Changes the password of the current user and revokes all their other sessions.
+// @tags account
+// @Security BearerAuth
+// @Accept json
+// @Param request body ChangePasswordRequest true "Current and new password"
+// @Success 204
+// @Failure 400 {object} ErrorResponse "Password does not satisfy the policy"
+// @Failure 401 {object} ErrorResponse "Invalid password"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a login session"
+// @Failure 429 {object} ErrorResponse "Too many failed login attempts"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /account/password [post]
+func ChangePasswordHandler(users UserStore, auth Authenticator, guard *loginGuard, policy PasswordPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		identity := identityFromContext(r.Context())
+		user, err := users.GetUserById(r.Context(), identity.UserId)
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid token")
+			return
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if !confirmPassword(w, r, guard, user, data.CurrentPassword) {
+			return
+		}
+		if err := policy.Validate(user.login, data.NewPassword); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		if err := users.SetUserPassword(r.Context(), user.id, data.NewPassword); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if err := auth.RevokeOthers(r.Context(), identity); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary Delete account
+// @Description Deletes the current user together with their sessions, API keys, tasks and results.
+// @tags account
+// @Security BearerAuth
+// @Accept json
+// @Param request body DeleteAccountRequest true "Password confirmation"
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid password"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a login session"
+// @Failure 429 {object} ErrorResponse "Too many failed login attempts"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /account [delete]
+func DeleteAccountHandler(store Storage, guard *loginGuard, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data DeleteAccountRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		identity := identityFromContext(r.Context())
+		user, err := store.GetUserById(r.Context(), identity.UserId)
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid token")
+			return
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if !confirmPassword(w, r, guard, user, data.Password) {
+			return
+		}
+
+		if err := store.DeleteUser(r.Context(), user.id); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		loggerFromContext(r.Context()).Info("User deleted their account", "user_id", user.id)
+		clearSessionCookie(w, cfg)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"a.b-c_d", true},
+		{"007", true},
+		{strings.Repeat("a", 32), true},
+		{"ab", false},
+		{strings.Repeat("a", 33), false},
+		{".alice", false},
+		{"-alice", false},
+		{"al ice", false},
+		{"alice@example.com", false},
+		{"алиса", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validateUsername(tt.username); (err == nil) != tt.valid {
+			t.Errorf("validateUsername(%q) = %v, want valid %v", tt.username, err, tt.valid)
+		}
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, RequireLetter: true, RequireDigit: true}
+	strict := PasswordPolicy{MinLength: 8, RequireLetter: true, RequireDigit: true, RequireSpecial: true}
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		message  string // contained in the error; empty if the password is valid
+	}{
+		{"valid", policy, "password1", ""},
+		{"too short", policy, "pass1", "at least 8 characters"},
+		{"length in characters, not bytes", policy, "пароль12", ""},
+		{"too long for bcrypt", policy, strings.Repeat("a", 72) + "1", "at most 72 bytes"},
+		{"contains the username", policy, "xALICE123", "username"},
+		{"no letter", policy, "12345678", "letter"},
+		{"no digit", policy, "password", "digit"},
+		{"no special character", strict, "password1", "special"},
+		{"special character", strict, "password1!", ""},
+		{"nothing required", PasswordPolicy{}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate("alice", tt.password)
+			if tt.message == "" {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.message)
+			}
+		})
+	}
+}
+
+// newTestSessions registers alice as u1 and logs her in twice, returning
+// the authenticator and the identities of both sessions.
+func newTestSessions(t *testing.T, store Storage) (Authenticator, Identity, Identity) {
+	t.Helper()
+	user := mustRegister(t, store, "u1", "alice")
+	auth := newSessionAuthenticator(store, Config{SessionIdleTimeout: time.Hour, SessionAbsoluteTimeout: time.Hour})
+	var identities [2]Identity
+	for i := range identities {
+		response, err := auth.Issue(user, httptest.NewRequest(http.MethodPost, "/login", nil))
+		must(t, err)
+		identities[i], err = auth.Authenticate(context.Background(), response.AccessToken)
+		must(t, err)
+	}
+	return auth, identities[0], identities[1]
+}
+
+func accountRequest(method string, target string, identity Identity, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey, identity))
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	auth, current, other := newTestSessions(t, store)
+	guard := newLoginGuard(testLockoutPolicy, LockoutPolicy{MaxFailures: 100, Base: time.Minute, Max: time.Minute, Window: time.Minute})
+	handler := ChangePasswordHandler(store, auth, guard, PasswordPolicy{MinLength: 8, RequireLetter: true, RequireDigit: true})
+
+	change := func(currentPassword, newPassword string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := json.Marshal(ChangePasswordRequest{CurrentPassword: currentPassword, NewPassword: newPassword})
+		must(t, err)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, accountRequest(http.MethodPost, "/account/password", current, string(body)))
+		return w
+	}
+	hasPassword := func(password string) bool {
+		t.Helper()
+		user, err := store.GetUserById(ctx, "u1")
+		must(t, err)
+		return bcrypt.CompareHashAndPassword([]byte(user.hash), []byte(password)) == nil
+	}
+
+	if w := change("guess", "newPassword2"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong current password: status %d, want 401", w.Code)
+	}
+	if w := change("password1", "short"); w.Code != http.StatusBadRequest {
+		t.Errorf("new password against the policy: status %d, want 400", w.Code)
+	}
+	if !hasPassword("password1") {
+		t.Fatal("password changed by a rejected request")
+	}
+	if _, err := store.GetSession(ctx, other.SessionId); err != nil {
+		t.Fatalf("other session revoked by a rejected request: %v", err)
+	}
+
+	if w := change("password1", "newPassword2"); w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204: %s", w.Code, w.Body)
+	}
+	if !hasPassword("newPassword2") {
+		t.Error("new password does not match")
+	}
+	if _, err := store.GetSession(ctx, current.SessionId); err != nil {
+		t.Errorf("current session: %v", err)
+	}
+	_, err := store.GetSession(ctx, other.SessionId)
+	mustBeMissing(t, err, "other session after a password change")
+}
+
+func TestChangePasswordHandlerLockout(t *testing.T) {
+	store := NewInMemoryStorage()
+	auth, current, _ := newTestSessions(t, store)
+	guard := newLoginGuard(testLockoutPolicy, LockoutPolicy{MaxFailures: 100, Base: time.Minute, Max: time.Minute, Window: time.Minute})
+	handler := ChangePasswordHandler(store, auth, guard, PasswordPolicy{})
+
+	change := func(currentPassword string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, accountRequest(http.MethodPost, "/account/password", current, `{"current_password":"`+currentPassword+`","new_password":"newPassword2"}`))
+		return w
+	}
+	for i := range testLockoutPolicy.MaxFailures {
+		if w := change("guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d, want 401", i, w.Code)
+		}
+	}
+	// The right password is refused while the account is locked, on /login too.
+	w := change("password1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("change while locked: status %d, Retry-After %q, want 429 and 60", w.Code, w.Header().Get("Retry-After"))
+	}
+	if wait := guard.RetryAfter("alice", "192.0.2.1", time.Now()); wait <= 0 {
+		t.Error("failed password changes did not lock /login")
+	}
+}
+
+func TestDeleteAccountHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	_, current, other := newTestSessions(t, store)
+	mustRegister(t, store, "u2", "bob")
+	now := time.Now()
+	must(t, store.SetTask(ctx, Task{Id: "t1", UserId: "u1", CreatedAt: now, Status: "in_progress"}))
+	must(t, store.SetTask(ctx, Task{Id: "t2", UserId: "u2", CreatedAt: now, Status: "in_progress"}))
+	must(t, store.SetAPIKey(ctx, APIKey{Id: "k1", UserId: "u1", Hash: hashToken("secret"), Scopes: []string{ScopeTasksRead}, CreatedAt: now}))
+	guard := newLoginGuard(testLockoutPolicy, testLockoutPolicy)
+	handler := DeleteAccountHandler(store, guard, Config{})
+
+	del := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, accountRequest(http.MethodDelete, "/account", current, `{"password":"`+password+`"}`))
+		return w
+	}
+
+	if w := del("guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d, want 401", w.Code)
+	}
+	if _, err := store.GetUserById(ctx, "u1"); err != nil {
+		t.Fatalf("user deleted with a wrong password: %v", err)
+	}
+
+	w := del("password1")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204: %s", w.Code, w.Body)
+	}
+	if cookie := w.Result().Cookies(); len(cookie) != 1 || cookie[0].Name != sessionCookieName || cookie[0].MaxAge >= 0 {
+		t.Errorf("cookies = %v, want the session cookie cleared", cookie)
+	}
+	_, err := store.GetUserById(ctx, "u1")
+	mustBeMissing(t, err, "deleted user")
+	for _, session := range []Identity{current, other} {
+		_, err = store.GetSession(ctx, session.SessionId)
+		mustBeMissing(t, err, "session of a deleted user")
+	}
+	_, err = store.GetTask(ctx, "t1")
+	mustBeMissing(t, err, "task of a deleted user")
+	_, err = store.GetAPIKeyByHash(ctx, hashToken("secret"))
+	mustBeMissing(t, err, "API key of a deleted user")
+	if _, err := store.GetTask(ctx, "t2"); err != nil {
+		t.Errorf("another user's task: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// ensureAdmin creates the bootstrap admin account from ADMIN_USERNAME and
+// ADMIN_PASSWORD, or promotes the user if it already exists.
+func ensureAdmin(ctx context.Context, users UserStore, username string, password string) error {
+	if username == "" || password == "" {
+		return nil
+	}
+	user, err := users.GetUserByLogin(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		if err := users.RegisterUser(ctx, uuid.New().String(), username, password); err != nil {
+			return err
+		}
+		user, err = users.GetUserByLogin(ctx, username)
+	}
+	if err != nil {
+		return err
+	}
+	if user.role != RoleAdmin {
+		if err := users.SetUserRole(ctx, user.id, RoleAdmin); err != nil {
+			return err
+		}
+		slog.Info("Granted admin role", "username", username)
+	}
+	return nil
+}
+
+type AdminUserResponse struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AdminTaskResponse struct {
+	Id         string    `json:"id"`
+	UserId     string    `json:"user_id"`
+	FilterName string    `json:"filter_name"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type PurgeTasksResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+type QueueResponse struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	Consumers int    `json:"consumers"`
+}
+
+// @Summary List users
+// @tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} AdminUserResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /admin/users [get]
+func AdminListUsersHandler(store UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := store.GetUsers(r.Context())
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].createdAt.Before(users[j].createdAt)
+		})
+
+		response := make([]AdminUserResponse, 0, len(users))
+		for _, user := range users {
+			response = append(response, AdminUserResponse{
+				Id:        user.id,
+				Username:  user.login,
+				Role:      user.role,
+				Disabled:  user.disabled,
+				CreatedAt: user.createdAt,
+			})
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// @Summary Disable user
+// @Description Blocks login and revokes all sessions of the user. API keys stop working while the account is disabled.
+// @tags admin
+// @Security BearerAuth
+// @Param userID path string true "User ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "not found"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /admin/users/{userID}/disable [post]
+func AdminDisableUserHandler(store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		if userID == identityFromContext(r.Context()).UserId {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "Admins cannot disable themselves")
+			return
+		}
+		if err := store.SetUserDisabled(r.Context(), userID, true); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if err := store.DeleteUserSessions(r.Context(), userID, ""); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if err := store.DeleteUserRefreshTokens(r.Context(), userID, ""); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		loggerFromContext(r.Context()).Info("User disabled", "user_id", userID, "by", identityFromContext(r.Context()).UserId)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary Enable user
+// @tags admin
+// @Security BearerAuth
+// @Param userID path string true "User ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "not found"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /admin/users/{userID}/enable [post]
+func AdminEnableUserHandler(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		if err := users.SetUserDisabled(r.Context(), userID, false); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// @Summary List all tasks
+// @tags admin
+// @Security BearerAuth
+// @Produce json
+// @Param status query string false "Only tasks with this status"
+// @Success 200 {array} AdminTaskResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /admin/tasks [get]
+func AdminListTasksHandler(store TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		tasks, err := store.GetTasks(r.Context())
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].CreatedAt.After(tasks[j].CreatedAt)
+		})
+
+		response := make([]AdminTaskResponse, 0, len(tasks))
+		for _, task := range tasks {
+			if status != "" && task.Status != status {
+				continue
+			}
+			response = append(response, AdminTaskResponse{
+				Id:         task.Id,
+				UserId:     task.UserId,
+				FilterName: task.FilterName,
+				Status:     task.Status,
+				CreatedAt:  task.CreatedAt,
+			})
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// @Summary Purge tasks
+// @Description Deletes tasks and their results. Without parameters every task is deleted.
+// @tags admin
+// @Security BearerAuth
+// @Produce json
+// @Param status query string false "Only tasks with this status"
+// @Param older_than query string false "Only tasks older than this duration, e.g. 24h"
+// @Success 200 {object} PurgeTasksResponse
+// @Failure 400 {object} ErrorResponse "Invalid older_than"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /admin/tasks [delete]
+func AdminPurgeTasksHandler(tasks TaskStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		createdBefore := time.Now()
+		if value := r.URL.Query().Get("older_than"); value != "" {
+			olderThan, err := time.ParseDuration(value)
+			if err != nil || olderThan < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid_request", "Invalid older_than")
+				return
+			}
+			createdBefore = createdBefore.Add(-olderThan)
+		}
+
+		deleted, err := tasks.DeleteTasks(r.Context(), r.URL.Query().Get("status"), createdBefore)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		loggerFromContext(r.Context()).Info("Tasks purged", "count", deleted, "by", identityFromContext(r.Context()).UserId)
+		json.NewEncoder(w).Encode(PurgeTasksResponse{Deleted: deleted})
+	}
+}
+
+// @Summary Get queue depth
+// @tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} QueueResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 502 {object} ErrorResponse "Failed to inspect queue"
+// @Router /admin/queue [get]
+func AdminQueueHandler(ch taskQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := declareTaskQueue(ch)
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, "queue_unavailable", "Failed to inspect queue")
+			return
+		}
+		json.NewEncoder(w).Encode(QueueResponse{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers})
+	}
+}
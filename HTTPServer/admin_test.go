@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newTestAdminRouter serves the admin routes as main does, with an admin
+// "root" (u0) and a regular user "alice" (u1), and returns their tokens.
+func newTestAdminRouter(t *testing.T, store Storage) (router http.Handler, admin string, user string) {
+	t.Helper()
+	auth := newSessionAuthenticator(store, Config{SessionIdleTimeout: time.Hour, SessionAbsoluteTimeout: time.Hour})
+	login := func(id, name string) string {
+		response, err := auth.Issue(mustRegister(t, store, id, name), httptest.NewRequest(http.MethodPost, "/login", nil))
+		must(t, err)
+		return response.AccessToken
+	}
+	admin = login("u0", "root")
+	must(t, store.SetUserRole(context.Background(), "u0", RoleAdmin))
+	user = login("u1", "alice")
+
+	r := chi.NewRouter()
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(authMiddleware(store, auth), requireSession, requireRole(RoleAdmin))
+		r.Get("/users", AdminListUsersHandler(store))
+		r.Post("/users/{userID}/disable", AdminDisableUserHandler(store))
+		r.Delete("/tasks", AdminPurgeTasksHandler(store))
+	})
+	r.With(authMiddleware(store, auth)).Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(identityFromContext(r.Context()).UserId))
+	})
+	return r, admin, user
+}
+
+func serveAs(handler http.Handler, method string, target string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestRequireRole(t *testing.T) {
+	router, admin, user := newTestAdminRouter(t, NewInMemoryStorage())
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"admin", admin, http.StatusOK},
+		{"regular user", user, http.StatusForbidden},
+		{"anonymous", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveAs(router, http.MethodGet, "/admin/users", tt.token); w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareRejectsDisabledUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	router, admin, user := newTestAdminRouter(t, store)
+	apiKey := apiKeyPrefix + "secret"
+	must(t, store.SetAPIKey(ctx, APIKey{Id: "k1", UserId: "u1", Hash: hashToken(apiKey), Scopes: []string{ScopeTasksRead}, CreatedAt: time.Now()}))
+	for _, token := range []string{user, apiKey} {
+		if w := serveAs(router, http.MethodGet, "/whoami", token); w.Code != http.StatusOK {
+			t.Fatalf("status %d before disabling, want 200", w.Code)
+		}
+	}
+
+	// Disabling keeps API keys, and a session may outlive it if revoking
+	// failed; both are rejected while the user is disabled.
+	must(t, store.SetUserDisabled(ctx, "u1", true))
+	for name, token := range map[string]string{"session": user, "API key": apiKey} {
+		if w := serveAs(router, http.MethodGet, "/whoami", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s of a disabled user: status %d, want 401", name, w.Code)
+		}
+	}
+
+	must(t, store.SetUserDisabled(ctx, "u1", false))
+	if w := serveAs(router, http.MethodPost, "/admin/users/u1/disable", admin); w.Code != http.StatusNoContent {
+		t.Fatalf("disable: status %d, want 204: %s", w.Code, w.Body)
+	}
+	_, err := store.GetSession(ctx, user)
+	mustBeMissing(t, err, "session of a disabled user")
+	if w := serveAs(router, http.MethodGet, "/whoami", apiKey); w.Code != http.StatusUnauthorized {
+		t.Errorf("API key of a disabled user: status %d, want 401", w.Code)
+	}
+}
+
+func TestAdminPurgeTasksHandler(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		deleted int
+		kept    []string
+	}{
+		{"everything", "", http.StatusOK, 4, nil},
+		{"by status", "?status=failed", http.StatusOK, 2, []string{"old-ready", "new-ready"}},
+		{"by age", "?older_than=1h", http.StatusOK, 2, []string{"new-ready", "new-failed"}},
+		{"by status and age", "?status=failed&older_than=1h", http.StatusOK, 1, []string{"old-ready", "new-ready", "new-failed"}},
+		{"invalid age", "?older_than=yesterday", http.StatusBadRequest, 0, []string{"old-ready", "old-failed", "new-ready", "new-failed"}},
+		{"negative age", "?older_than=-1h", http.StatusBadRequest, 0, []string{"old-ready", "old-failed", "new-ready", "new-failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryStorage()
+			router, admin, _ := newTestAdminRouter(t, store)
+			for _, task := range []Task{
+				{Id: "old-ready", UserId: "u1", Status: "ready", CreatedAt: now.Add(-2 * time.Hour)},
+				{Id: "old-failed", UserId: "u1", Status: "failed", CreatedAt: now.Add(-2 * time.Hour)},
+				{Id: "new-ready", UserId: "u1", Status: "ready", CreatedAt: now.Add(-time.Minute)},
+				{Id: "new-failed", UserId: "u1", Status: "failed", CreatedAt: now.Add(-time.Minute)},
+			} {
+				must(t, store.SetTask(ctx, task))
+			}
+
+			w := serveAs(router, http.MethodDelete, "/admin/tasks"+tt.query, admin)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if w.Code == http.StatusOK {
+				var response PurgeTasksResponse
+				must(t, json.NewDecoder(w.Body).Decode(&response))
+				if response.Deleted != tt.deleted {
+					t.Errorf("deleted %d, want %d", response.Deleted, tt.deleted)
+				}
+			}
+			tasks, err := store.GetTasks(ctx)
+			must(t, err)
+			kept := make(map[string]bool)
+			for _, task := range tasks {
+				kept[task.Id] = true
+			}
+			if len(kept) != len(tt.kept) {
+				t.Errorf("kept %v, want %v", kept, tt.kept)
+			}
+			for _, id := range tt.kept {
+				if !kept[id] {
+					t.Errorf("%s was deleted", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	apiKeyPrefix = "ipk_"
+	apiKeyHeader = "X-API-Key"
+
+	ScopeTasksRead  = "tasks:read"
+	ScopeTasksWrite = "tasks:write"
+)
+
+var apiKeyScopes = []string{ScopeTasksRead, ScopeTasksWrite}
+
+func generateAPIKey() (string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + secret, nil
+}
+
+func authenticateAPIKey(ctx context.Context, users UserStore, key string) (Identity, error) {
+	apiKey, err := users.GetAPIKeyByHash(ctx, hashToken(key))
+	now := time.Now()
+	if errors.Is(err, ErrNotFound) || err == nil && apiKey.Expired(now) {
+		return Identity{}, errInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	user, err := users.GetUserById(ctx, apiKey.UserId)
+	if errors.Is(err, ErrNotFound) || err == nil && user.disabled {
+		return Identity{}, errInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := users.TouchAPIKey(ctx, apiKey.Id, now); err != nil {
+		loggerFromContext(ctx).Error("Failed to record API key use", "api_key_id", apiKey.Id, "error", err)
+	}
+	return Identity{UserId: user.id, Role: user.role, APIKeyId: apiKey.Id, Scopes: apiKey.Scopes}, nil
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" example:"ci"`
+	Scopes    []string   `json:"scopes" example:"tasks:read,tasks:write"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type APIKeyResponse struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	// Key is the plaintext key. It is only ever returned once.
+	Key string `json:"key"`
+}
+
+func newAPIKeyResponse(key APIKey) APIKeyResponse {
+	response := APIKeyResponse{
+		Id:        key.Id,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.ExpiresAt.IsZero() {
+		response.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		response.LastUsedAt = &key.LastUsedAt
+	}
+	return response
+}
+
+// @Summary Create API key
+// @Description Creates a long-lived key for machine clients. Send it as "X-API-Key: <key>" or "Authorization: Bearer <key>". The key is shown only in this response.
+// @tags apikeys
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param key body CreateAPIKeyRequest true "Key settings"
+// @Success 201 {object} CreateAPIKeyResponse
+// @Failure 400 {object} ErrorResponse "Invalid input"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a login session"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /apikeys [post]
+func CreateAPIKeyHandler(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data CreateAPIKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		if strings.TrimSpace(data.Name) == "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "Missing key name")
+			return
+		}
+		if len(data.Scopes) == 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "At least one scope is required")
+			return
+		}
+		for _, scope := range data.Scopes {
+			if !slices.Contains(apiKeyScopes, scope) {
+				writeError(w, r, http.StatusBadRequest, "invalid_request", "Unknown scope "+scope)
+				return
+			}
+		}
+		now := time.Now()
+		if data.ExpiresAt != nil && !data.ExpiresAt.After(now) {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "expires_at must be in the future")
+			return
+		}
+
+		plaintext, err := generateAPIKey()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Failed to generate key")
+			return
+		}
+
+		key := APIKey{
+			Id:        uuid.New().String(),
+			UserId:    identityFromContext(r.Context()).UserId,
+			Name:      strings.TrimSpace(data.Name),
+			Prefix:    plaintext[:len(apiKeyPrefix)+8],
+			Hash:      hashToken(plaintext),
+			Scopes:    slices.Compact(slices.Sorted(slices.Values(data.Scopes))),
+			CreatedAt: now,
+		}
+		if data.ExpiresAt != nil {
+			key.ExpiresAt = *data.ExpiresAt
+		}
+		if err := users.SetAPIKey(r.Context(), key); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKeyResponse: newAPIKeyResponse(key), Key: plaintext})
+	}
+}
+
+// @Summary List API keys
+// @tags apikeys
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} APIKeyResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a login session"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /apikeys [get]
+func ListAPIKeysHandler(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := users.GetUserAPIKeys(r.Context(), identityFromContext(r.Context()).UserId)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		})
+
+		response := make([]APIKeyResponse, 0, len(keys))
+		for _, key := range keys {
+			response = append(response, newAPIKeyResponse(key))
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// @Summary Revoke API key
+// @tags apikeys
+// @Security BearerAuth
+// @Param keyID path string true "API key ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "This endpoint requires a login session"
+// @Failure 404 {object} ErrorResponse "not found"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /apikeys/{keyID} [delete]
+func DeleteAPIKeyHandler(users UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyID := chi.URLParam(r, "keyID")
+		if err := users.DeleteAPIKey(r.Context(), identityFromContext(r.Context()).UserId, keyID); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newTestAPIKeyRouter serves the API key routes as main does, next to stub
+// task routes that only check scopes, and returns a session token of alice.
+func newTestAPIKeyRouter(t *testing.T, store Storage) (http.Handler, string) {
+	t.Helper()
+	auth := newSessionAuthenticator(store, Config{SessionIdleTimeout: time.Hour, SessionAbsoluteTimeout: time.Hour})
+	response, err := auth.Issue(mustRegister(t, store, "u1", "alice"), httptest.NewRequest(http.MethodPost, "/login", nil))
+	must(t, err)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r := chi.NewRouter()
+	r.With(authMiddleware(store, auth), requireScope(ScopeTasksWrite)).Post("/task", ok)
+	r.With(authMiddleware(store, auth), requireScope(ScopeTasksRead)).Get("/status/{taskID}", ok)
+	r.With(authMiddleware(store, auth), requireSession).Post("/apikeys", CreateAPIKeyHandler(store))
+	r.With(authMiddleware(store, auth), requireSession).Get("/apikeys", ListAPIKeysHandler(store))
+	r.With(authMiddleware(store, auth), requireSession).Delete("/apikeys/{keyID}", DeleteAPIKeyHandler(store))
+	return r, response.AccessToken
+}
+
+func createAPIKey(t *testing.T, router http.Handler, session string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/apikeys", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+session)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+	router, session := newTestAPIKeyRouter(t, NewInMemoryStorage())
+
+	w := createAPIKey(t, router, session, `{"name":" ci ","scopes":["tasks:read"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, want 201: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var created CreateAPIKeyResponse
+	must(t, json.NewDecoder(w.Body).Decode(&created))
+	if !strings.HasPrefix(created.Key, created.Prefix) || !strings.HasPrefix(created.Prefix, apiKeyPrefix) || created.Name != "ci" {
+		t.Errorf("created %+v, want a key starting with its prefix, named ci", created)
+	}
+
+	// The key is never shown again.
+	w = serveAs(router, http.MethodGet, "/apikeys", session)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status %d, want 200", w.Code)
+	}
+	if strings.Contains(w.Body.String(), created.Key) || strings.Contains(w.Body.String(), `"key"`) {
+		t.Errorf("list shows the key: %s", w.Body)
+	}
+	var listed []APIKeyResponse
+	must(t, json.NewDecoder(w.Body).Decode(&listed))
+	if len(listed) != 1 || listed[0].Id != created.Id || listed[0].Prefix != created.Prefix {
+		t.Errorf("listed %+v, want the created key", listed)
+	}
+
+	// A read-only key reads but does not write, and cannot manage keys.
+	withKey := func(method, target string) int {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set(apiKeyHeader, created.Key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := withKey(http.MethodGet, "/status/t1"); code != http.StatusOK {
+		t.Errorf("GET /status with a read-only key: status %d, want 200", code)
+	}
+	if code := serveAs(router, http.MethodGet, "/status/t1", created.Key).Code; code != http.StatusOK {
+		t.Errorf("GET /status with the key as a bearer token: status %d, want 200", code)
+	}
+	if code := withKey(http.MethodPost, "/task"); code != http.StatusForbidden {
+		t.Errorf("POST /task with a read-only key: status %d, want 403", code)
+	}
+	if code := withKey(http.MethodGet, "/apikeys"); code != http.StatusForbidden {
+		t.Errorf("GET /apikeys with a key: status %d, want 403", code)
+	}
+
+	if code := serveAs(router, http.MethodDelete, "/apikeys/"+created.Id, session).Code; code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d, want 204", code)
+	}
+	if code := withKey(http.MethodGet, "/status/t1"); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status %d, want 401", code)
+	}
+}
+
+func TestCreateAPIKeyHandlerValidation(t *testing.T) {
+	router, session := newTestAPIKeyRouter(t, NewInMemoryStorage())
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing name", `{"name":" ","scopes":["tasks:read"]}`},
+		{"no scopes", `{"name":"ci","scopes":[]}`},
+		{"unknown scope", `{"name":"ci","scopes":["admin"]}`},
+		{"expired", `{"name":"ci","scopes":["tasks:read"],"expires_at":"` + past + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := createAPIKey(t, router, session, tt.body); w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+)
+
+// audit logs a security relevant event together with the client address.
+// fields are key/value pairs added as attributes of the log line.
+func audit(r *http.Request, event string, fields ...string) {
+	args := []any{"event", event, "ip", clientIP(r)}
+	for i := 0; i+1 < len(fields); i += 2 {
+		args = append(args, fields[i], fields[i+1])
+	}
+	loggerFromContext(r.Context()).Info("audit", args...)
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	boltUsers         = []byte("users")
+	boltUserLogins    = []byte("user_logins")
+	boltSessions      = []byte("sessions")
+	boltAPIKeys       = []byte("api_keys")
+	boltAPIKeyHashes  = []byte("api_key_hashes")
+	boltRefreshTokens = []byte("refresh_tokens")
+	boltTasks         = []byte("tasks")
+	boltTaskExpiry    = []byte("task_expiry")
+	boltUsage         = []byte("usage")
+	boltIdempotency   = []byte("idempotency_keys")
+	boltResultCache   = []byte("result_cache")
+)
+
+// BoltStorage keeps users, sessions and tasks in a single bbolt file, for
+// single-node deployments that should survive restarts without running a
+// database server. Records are stored as JSON keyed by ID; user_logins and
+// api_key_hashes are secondary indexes. usage is keyed by
+// "<user>/<YYYY-MM-DD>" so that a user's days sort together,
+// idempotency_keys by "<user>/<key>" and result_cache by content hash.
+// task_expiry indexes ready tasks by when their result expires; see
+// boltTaskExpiryKey. bbolt cannot cancel transactions, so
+// the contexts passed in are ignored.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// boltUser is the stored form of User, whose fields are unexported.
+type boltUser struct {
+	Id        string
+	Login     string
+	Hash      string
+	Role      string
+	Disabled  bool
+	CreatedAt time.Time
+}
+
+// NewBoltStorage opens or creates the database file at path. Only one
+// process can hold the file open at a time.
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsers, boltUserLogins, boltSessions, boltAPIKeys, boltAPIKeyHashes, boltRefreshTokens, boltTasks, boltTaskExpiry, boltUsage, boltIdempotency, boltResultCache} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// boltError wraps failures other than ErrNotFound and ErrUserExists with
+// the operation that failed.
+func boltError(op string, err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrUserExists) {
+		return err
+	}
+	return &StorageError{Op: "bolt " + op, Err: err}
+}
+
+func (s *BoltStorage) Ping(ctx context.Context) error {
+	return s.view("ping", func(tx *bolt.Tx) error { return nil })
+}
+
+func (s *BoltStorage) view(op string, fn func(tx *bolt.Tx) error) error {
+	return boltError(op, s.db.View(fn))
+}
+
+func (s *BoltStorage) update(op string, fn func(tx *bolt.Tx) error) error {
+	return boltError(op, s.db.Update(fn))
+}
+
+func boltPut(tx *bolt.Tx, bucket []byte, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// boltGet decodes the record stored under key, returning ErrNotFound if
+// there is none.
+func boltGet(tx *bolt.Tx, bucket []byte, key string, value any) error {
+	data := tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, value)
+}
+
+// boltEach decodes every record in bucket. Records must not be deleted from
+// fn; collect their keys and delete them afterwards.
+func boltEach[T any](tx *bolt.Tx, bucket []byte, fn func(value T) error) error {
+	return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+		var value T
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		return fn(value)
+	})
+}
+
+// boltDeleteWhere deletes the records of bucket that match and returns how
+// many were deleted.
+func boltDeleteWhere[T any](tx *bolt.Tx, bucket []byte, match func(value T) bool) (int, error) {
+	var keys [][]byte
+	err := tx.Bucket(bucket).ForEach(func(key, data []byte) error {
+		var value T
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		if match(value) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := tx.Bucket(bucket).Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// boltDeletePrefix deletes the records of bucket whose keys start with
+// prefix.
+func boltDeletePrefix(tx *bolt.Tx, bucket []byte, prefix string) error {
+	c := tx.Bucket(bucket).Cursor()
+	for key, _ := c.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = c.Seek([]byte(prefix)) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltTaskExpiryKey returns the key of the task in task_expiry: the expiry
+// of its result in big-endian Unix nanoseconds, so that keys sort by time,
+// followed by the task ID. Only ready tasks whose result expires are
+// indexed; for others it returns nil.
+func boltTaskExpiryKey(task Task) []byte {
+	if task.Status != "ready" || task.ExpiresAt.IsZero() {
+		return nil
+	}
+	key := binary.BigEndian.AppendUint64(nil, uint64(task.ExpiresAt.UnixNano()))
+	return append(key, task.Id...)
+}
+
+// boltPutTask stores the task and keeps task_expiry in step with it.
+func boltPutTask(tx *bolt.Tx, task Task) error {
+	var old Task
+	err := boltGet(tx, boltTasks, task.Id, &old)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if key := boltTaskExpiryKey(old); err == nil && key != nil {
+		if err := tx.Bucket(boltTaskExpiry).Delete(key); err != nil {
+			return err
+		}
+	}
+	if key := boltTaskExpiryKey(task); key != nil {
+		if err := tx.Bucket(boltTaskExpiry).Put(key, nil); err != nil {
+			return err
+		}
+	}
+	return boltPut(tx, boltTasks, task.Id, task)
+}
+
+// boltDeleteTask deletes the task and its task_expiry entry.
+func boltDeleteTask(tx *bolt.Tx, task Task) error {
+	if key := boltTaskExpiryKey(task); key != nil {
+		if err := tx.Bucket(boltTaskExpiry).Delete(key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltTasks).Delete([]byte(task.Id))
+}
+
+// boltDeleteTasksWhere deletes the tasks that match, and their task_expiry
+// entries, and returns how many were deleted.
+func boltDeleteTasksWhere(tx *bolt.Tx, match func(task Task) bool) (int, error) {
+	var expiryKeys [][]byte
+	removed, err := boltDeleteWhere(tx, boltTasks, func(task Task) bool {
+		if !match(task) {
+			return false
+		}
+		if key := boltTaskExpiryKey(task); key != nil {
+			expiryKeys = append(expiryKeys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range expiryKeys {
+		if err := tx.Bucket(boltTaskExpiry).Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+func (s *BoltStorage) SetTask(ctx context.Context, task Task) error {
+	return s.update("set task", func(tx *bolt.Tx) error {
+		return boltPutTask(tx, task)
+	})
+}
+
+func (s *BoltStorage) GetTask(ctx context.Context, id string) (Task, error) {
+	var task Task
+	err := s.view("get task", func(tx *bolt.Tx) error {
+		return boltGet(tx, boltTasks, id, &task)
+	})
+	return task, err
+}
+
+func (s *BoltStorage) GetTasks(ctx context.Context) ([]Task, error) {
+	var tasks []Task
+	err := s.view("list tasks", func(tx *bolt.Tx) error {
+		return boltEach(tx, boltTasks, func(task Task) error {
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+func (s *BoltStorage) DeleteTasks(ctx context.Context, status string, createdBefore time.Time) (int, error) {
+	var removed int
+	err := s.update("delete tasks", func(tx *bolt.Tx) (err error) {
+		removed, err = boltDeleteTasksWhere(tx, func(task Task) bool {
+			return (status == "" || task.Status == status) && task.CreatedAt.Before(createdBefore)
+		})
+		return err
+	})
+	return removed, err
+}
+
+// DeleteExpiredResults walks task_expiry up to now, so it only reads the
+// tasks that are due.
+func (s *BoltStorage) DeleteExpiredResults(ctx context.Context, now time.Time) (int, error) {
+	removed := 0
+	err := s.update("delete expired results", func(tx *bolt.Tx) error {
+		end := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+		var due [][]byte
+		c := tx.Bucket(boltTaskExpiry).Cursor()
+		for key, _ := c.First(); key != nil && bytes.Compare(key[:8], end) <= 0; key, _ = c.Next() {
+			due = append(due, bytes.Clone(key))
+		}
+		for _, key := range due {
+			var task Task
+			err := boltGet(tx, boltTasks, string(key[8:]), &task)
+			if errors.Is(err, ErrNotFound) {
+				// A stale entry; the task is gone already.
+				if err := tx.Bucket(boltTaskExpiry).Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if task.SourceId != "" {
+				err = boltDeleteTask(tx, task)
+			} else {
+				err = boltPutTask(tx, task.expire())
+			}
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func boltUsageKey(UserId string, day time.Time) string {
+	return UserId + "/" + usageDay(day).Format(time.DateOnly)
+}
+
+func (s *BoltStorage) AddUsage(ctx context.Context, UserId string, at time.Time, delta Usage) error {
+	return s.update("add usage", func(tx *bolt.Tx) error {
+		key := boltUsageKey(UserId, at)
+		var usage Usage
+		if err := boltGet(tx, boltUsage, key, &usage); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return boltPut(tx, boltUsage, key, usage.Add(delta))
+	})
+}
+
+func (s *BoltStorage) GetUsage(ctx context.Context, UserId string, from time.Time, to time.Time) (Usage, error) {
+	var total Usage
+	err := s.view("get usage", func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUsage).Cursor()
+		first, end := usageDays(from, to)
+		last := []byte(boltUsageKey(UserId, end))
+		for key, data := c.Seek([]byte(boltUsageKey(UserId, first))); key != nil && bytes.Compare(key, last) < 0; key, data = c.Next() {
+			var usage Usage
+			if err := json.Unmarshal(data, &usage); err != nil {
+				return err
+			}
+			total = total.Add(usage)
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (s *BoltStorage) ClaimIdempotencyKey(ctx context.Context, key IdempotencyKey, now time.Time) (IdempotencyKey, error) {
+	claimed := key
+	err := s.update("claim idempotency key", func(tx *bolt.Tx) error {
+		id := key.UserId + "/" + key.Key
+		var existing IdempotencyKey
+		err := boltGet(tx, boltIdempotency, id, &existing)
+		if err == nil && !existing.Expired(now) {
+			claimed = existing
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return boltPut(tx, boltIdempotency, id, key)
+	})
+	return claimed, err
+}
+
+func (s *BoltStorage) DeleteIdempotencyKey(ctx context.Context, UserId string, key string) error {
+	return s.update("delete idempotency key", func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdempotency).Delete([]byte(UserId + "/" + key))
+	})
+}
+
+func (s *BoltStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	var removed int
+	err := s.update("delete expired idempotency keys", func(tx *bolt.Tx) error {
+		var err error
+		removed, err = boltDeleteWhere(tx, boltIdempotency, func(key IdempotencyKey) bool { return key.Expired(now) })
+		return err
+	})
+	return removed, err
+}
+
+func (s *BoltStorage) SetCachedResult(ctx context.Context, entry CachedResult) error {
+	return s.update("set cached result", func(tx *bolt.Tx) error {
+		return boltPut(tx, boltResultCache, entry.ContentHash, entry)
+	})
+}
+
+func (s *BoltStorage) GetCachedResult(ctx context.Context, hash string, now time.Time) (CachedResult, error) {
+	var entry CachedResult
+	err := s.view("get cached result", func(tx *bolt.Tx) error {
+		if err := boltGet(tx, boltResultCache, hash, &entry); err != nil {
+			return err
+		}
+		if entry.Expired(now) {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (s *BoltStorage) DeleteExpiredCachedResults(ctx context.Context, now time.Time) (int, error) {
+	var removed int
+	err := s.update("delete expired cached results", func(tx *bolt.Tx) error {
+		var err error
+		removed, err = boltDeleteWhere(tx, boltResultCache, func(entry CachedResult) bool { return entry.Expired(now) })
+		return err
+	})
+	return removed, err
+}
+
+func (u boltUser) user() User {
+	return User{id: u.Id, login: u.Login, hash: u.Hash, role: u.Role, disabled: u.Disabled, createdAt: u.CreatedAt}
+}
+
+func (s *BoltStorage) RegisterUser(ctx context.Context, id string, username string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return s.update("register user", func(tx *bolt.Tx) error {
+		logins := tx.Bucket(boltUserLogins)
+		if logins.Get([]byte(username)) != nil {
+			return ErrUserExists
+		}
+		if err := logins.Put([]byte(username), []byte(id)); err != nil {
+			return err
+		}
+		return boltPut(tx, boltUsers, id, boltUser{
+			Id: id, Login: username, Hash: string(hashedPassword), Role: RoleUser, CreatedAt: time.Now(),
+		})
+	})
+}
+
+func (s *BoltStorage) GetUserByLogin(ctx context.Context, login string) (User, error) {
+	var user boltUser
+	err := s.view("get user by login", func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltUserLogins).Get([]byte(login))
+		if id == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx, boltUsers, string(id), &user)
+	})
+	return user.user(), err
+}
+
+func (s *BoltStorage) GetUserById(ctx context.Context, id string) (User, error) {
+	var user boltUser
+	err := s.view("get user", func(tx *bolt.Tx) error {
+		return boltGet(tx, boltUsers, id, &user)
+	})
+	return user.user(), err
+}
+
+func (s *BoltStorage) GetUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := s.view("list users", func(tx *bolt.Tx) error {
+		return boltEach(tx, boltUsers, func(user boltUser) error {
+			users = append(users, user.user())
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *BoltStorage) SetUserRole(ctx context.Context, id string, role string) error {
+	return s.updateUser("set user role", id, func(user *boltUser) { user.Role = role })
+}
+
+func (s *BoltStorage) SetUserDisabled(ctx context.Context, id string, disabled bool) error {
+	return s.updateUser("set user disabled", id, func(user *boltUser) { user.Disabled = disabled })
+}
+
+func (s *BoltStorage) SetUserPassword(ctx context.Context, id string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	return s.updateUser("set user password", id, func(user *boltUser) { user.Hash = string(hashedPassword) })
+}
+
+func (s *BoltStorage) updateUser(op string, id string, update func(user *boltUser)) error {
+	return s.update(op, func(tx *bolt.Tx) error {
+		var user boltUser
+		if err := boltGet(tx, boltUsers, id, &user); err != nil {
+			return err
+		}
+		update(&user)
+		return boltPut(tx, boltUsers, id, user)
+	})
+}
+
+func (s *BoltStorage) DeleteUser(ctx context.Context, id string) error {
+	return s.update("delete user", func(tx *bolt.Tx) error {
+		var user boltUser
+		if err := boltGet(tx, boltUsers, id, &user); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltUsers).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltUserLogins).Delete([]byte(user.Login)); err != nil {
+			return err
+		}
+
+		if _, err := boltDeleteWhere(tx, boltSessions, func(session Session) bool { return session.UserId == id }); err != nil {
+			return err
+		}
+		if _, err := boltDeleteWhere(tx, boltRefreshTokens, func(token RefreshToken) bool { return token.UserId == id }); err != nil {
+			return err
+		}
+		if _, err := boltDeleteTasksWhere(tx, func(task Task) bool { return task.UserId == id }); err != nil {
+			return err
+		}
+		if err := boltDeletePrefix(tx, boltUsage, id+"/"); err != nil {
+			return err
+		}
+		if err := boltDeletePrefix(tx, boltIdempotency, id+"/"); err != nil {
+			return err
+		}
+		if _, err := boltDeleteWhere(tx, boltResultCache, func(entry CachedResult) bool { return entry.UserId == id }); err != nil {
+			return err
+		}
+		var hashes []string
+		_, err := boltDeleteWhere(tx, boltAPIKeys, func(key APIKey) bool {
+			if key.UserId == id {
+				hashes = append(hashes, key.Hash)
+			}
+			return key.UserId == id
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := tx.Bucket(boltAPIKeyHashes).Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) SetSession(ctx context.Context, session Session) error {
+	return s.update("set session", func(tx *bolt.Tx) error {
+		return boltPut(tx, boltSessions, session.SessionId, session)
+	})
+}
+
+func (s *BoltStorage) GetSession(ctx context.Context, SessionId string) (Session, error) {
+	var session Session
+	err := s.view("get session", func(tx *bolt.Tx) error {
+		return boltGet(tx, boltSessions, SessionId, &session)
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if session.Expired(time.Now()) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *BoltStorage) TouchSession(ctx context.Context, SessionId string, now time.Time) error {
+	return s.update("touch session", func(tx *bolt.Tx) error {
+		var session Session
+		if err := boltGet(tx, boltSessions, SessionId, &session); err != nil {
+			return err
+		}
+		session.LastSeenAt = now
+		return boltPut(tx, boltSessions, SessionId, session)
+	})
+}
+
+func (s *BoltStorage) DeleteSession(ctx context.Context, SessionId string) error {
+	return s.update("delete session", func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSessions).Delete([]byte(SessionId))
+	})
+}
+
+func (s *BoltStorage) GetUserSessions(ctx context.Context, UserId string) ([]Session, error) {
+	now := time.Now()
+	var sessions []Session
+	err := s.view("list user sessions", func(tx *bolt.Tx) error {
+		return boltEach(tx, boltSessions, func(session Session) error {
+			if session.UserId == UserId && !session.Expired(now) {
+				sessions = append(sessions, session)
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (s *BoltStorage) DeleteUserSessions(ctx context.Context, UserId string, keepSessionId string) error {
+	return s.update("delete user sessions", func(tx *bolt.Tx) error {
+		_, err := boltDeleteWhere(tx, boltSessions, func(session Session) bool {
+			return session.UserId == UserId && session.SessionId != keepSessionId
+		})
+		return err
+	})
+}
+
+func (s *BoltStorage) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	var removed int
+	err := s.update("delete expired sessions", func(tx *bolt.Tx) (err error) {
+		removed, err = boltDeleteWhere(tx, boltSessions, func(session Session) bool { return session.Expired(now) })
+		return err
+	})
+	return removed, err
+}
+
+func (s *BoltStorage) SetAPIKey(ctx context.Context, key APIKey) error {
+	return s.update("set api key", func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltAPIKeyHashes).Put([]byte(key.Hash), []byte(key.Id)); err != nil {
+			return err
+		}
+		return boltPut(tx, boltAPIKeys, key.Id, key)
+	})
+}
+
+func (s *BoltStorage) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	err := s.view("get api key", func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltAPIKeyHashes).Get([]byte(hash))
+		if id == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx, boltAPIKeys, string(id), &key)
+	})
+	return key, err
+}
+
+func (s *BoltStorage) GetUserAPIKeys(ctx context.Context, UserId string) ([]APIKey, error) {
+	var keys []APIKey
+	err := s.view("list user api keys", func(tx *bolt.Tx) error {
+		return boltEach(tx, boltAPIKeys, func(key APIKey) error {
+			if key.UserId == UserId {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *BoltStorage) TouchAPIKey(ctx context.Context, id string, now time.Time) error {
+	return s.update("touch api key", func(tx *bolt.Tx) error {
+		var key APIKey
+		if err := boltGet(tx, boltAPIKeys, id, &key); err != nil {
+			return err
+		}
+		key.LastUsedAt = now
+		return boltPut(tx, boltAPIKeys, id, key)
+	})
+}
+
+func (s *BoltStorage) DeleteAPIKey(ctx context.Context, UserId string, id string) error {
+	return s.update("delete api key", func(tx *bolt.Tx) error {
+		var key APIKey
+		if err := boltGet(tx, boltAPIKeys, id, &key); err != nil {
+			return err
+		}
+		if key.UserId != UserId {
+			return ErrNotFound
+		}
+		if err := tx.Bucket(boltAPIKeyHashes).Delete([]byte(key.Hash)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltAPIKeys).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStorage) SetRefreshToken(ctx context.Context, token RefreshToken) error {
+	return s.update("set refresh token", func(tx *bolt.Tx) error {
+		return boltPut(tx, boltRefreshTokens, token.Id, token)
+	})
+}
+
+func (s *BoltStorage) GetRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	var token RefreshToken
+	err := s.view("get refresh token", func(tx *bolt.Tx) error {
+		return boltGet(tx, boltRefreshTokens, id, &token)
+	})
+	return token, err
+}
+
+// RotateRefreshToken replaces the token's hash if it still equals oldHash.
+// bbolt serializes write transactions, so the check and the write are atomic.
+func (s *BoltStorage) RotateRefreshToken(ctx context.Context, id string, oldHash string, newHash string, now time.Time) error {
+	return s.update("rotate refresh token", func(tx *bolt.Tx) error {
+		var token RefreshToken
+		if err := boltGet(tx, boltRefreshTokens, id, &token); err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(oldHash)) != 1 {
+			return ErrNotFound
+		}
+		token.Hash = newHash
+		token.LastUsedAt = now
+		return boltPut(tx, boltRefreshTokens, id, token)
+	})
+}
+
+func (s *BoltStorage) DeleteRefreshToken(ctx context.Context, id string) error {
+	return s.update("delete refresh token", func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRefreshTokens).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStorage) GetUserRefreshTokens(ctx context.Context, UserId string) ([]RefreshToken, error) {
+	now := time.Now()
+	var tokens []RefreshToken
+	err := s.view("list user refresh tokens", func(tx *bolt.Tx) error {
+		return boltEach(tx, boltRefreshTokens, func(token RefreshToken) error {
+			if token.UserId == UserId && !token.Expired(now) {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+func (s *BoltStorage) DeleteUserRefreshTokens(ctx context.Context, UserId string, keepId string) error {
+	return s.update("delete user refresh tokens", func(tx *bolt.Tx) error {
+		_, err := boltDeleteWhere(tx, boltRefreshTokens, func(token RefreshToken) bool {
+			return token.UserId == UserId && token.Id != keepId
+		})
+		return err
+	})
+}
+
+func (s *BoltStorage) DeleteExpiredRefreshTokens(ctx context.Context, now time.Time) (int, error) {
+	var removed int
+	err := s.update("delete expired refresh tokens", func(tx *bolt.Tx) (err error) {
+		removed, err = boltDeleteWhere(tx, boltRefreshTokens, func(token RefreshToken) bool { return token.Expired(now) })
+		return err
+	})
+	return removed, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		store, err := NewBoltStorage(filepath.Join(t.TempDir(), "storage.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+// TestBoltStorageReopen checks that data survives closing and reopening the
+// file, which is the point of this backend.
+func TestBoltStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	store, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRegister(t, store, "u1", "alice")
+	must(t, store.SetTask(context.Background(), Task{Id: "t1", UserId: "u1", Status: "ready"}))
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if user, err := store.GetUserByLogin(context.Background(), "alice"); err != nil || user.id != "u1" {
+		t.Errorf("GetUserByLogin after reopen = %+v, %v", user, err)
+	}
+	if task, err := store.GetTask(context.Background(), "t1"); err != nil || task.Status != "ready" {
+		t.Errorf("GetTask after reopen = %+v, %v", task, err)
+	}
+}
+
+// TestBoltStorageTaskExpiryIndex checks that task_expiry holds exactly the
+// ready tasks with an expiry.
+func TestBoltStorageTaskExpiryIndex(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "storage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now()
+	must(t, store.SetTask(ctx, Task{Id: "pending", Status: "in_progress", ResultTTL: time.Hour}))
+	must(t, store.SetTask(ctx, Task{Id: "forever", Status: "ready"}))
+	must(t, store.SetTask(ctx, Task{Id: "t1", Status: "ready", ExpiresAt: now.Add(time.Minute)}))
+	must(t, store.SetTask(ctx, Task{Id: "t1", Status: "ready", ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetTask(ctx, Task{Id: "t2", Status: "ready", ExpiresAt: now.Add(2 * time.Hour)}))
+
+	indexed := func() int {
+		t.Helper()
+		n := 0
+		err := store.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(boltTaskExpiry).Stats().KeyN
+			return nil
+		})
+		must(t, err)
+		return n
+	}
+	if n := indexed(); n != 2 {
+		t.Errorf("task_expiry has %d entries, want 2", n)
+	}
+
+	if removed, err := store.DeleteExpiredResults(ctx, now.Add(time.Hour)); err != nil || removed != 1 {
+		t.Errorf("DeleteExpiredResults = %d, %v, want 1", removed, err)
+	}
+	if n := indexed(); n != 1 {
+		t.Errorf("task_expiry has %d entries after expiry, want 1", n)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LockoutPolicy describes progressive lockout: after MaxFailures failed
+// attempts the key is locked for Base, and every further failure doubles the
+// lockout up to Max. Failures are forgotten after Window without any.
+type LockoutPolicy struct {
+	MaxFailures int
+	Base        time.Duration
+	Max         time.Duration
+	Window      time.Duration
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type lockoutTracker struct {
+	policy LockoutPolicy
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+func newLockoutTracker(policy LockoutPolicy) *lockoutTracker {
+	return &lockoutTracker{policy: policy, entries: make(map[string]*lockoutEntry)}
+}
+
+// RetryAfter returns how long key stays locked, or zero if it is not.
+func (t *lockoutTracker) RetryAfter(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, exists := t.entries[key]
+	if !exists || !now.Before(entry.lockedUntil) {
+		return 0
+	}
+	return entry.lockedUntil.Sub(now)
+}
+
+// Fail records a failed attempt and returns the lockout it caused, if any.
+func (t *lockoutTracker) Fail(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, exists := t.entries[key]
+	if !exists || now.Sub(entry.lastFailure) > t.policy.Window {
+		entry = &lockoutEntry{}
+		t.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures < t.policy.MaxFailures {
+		return 0
+	}
+
+	lockout := t.policy.Base
+	for i := t.policy.MaxFailures; i < entry.failures && lockout < t.policy.Max; i++ {
+		lockout *= 2
+	}
+	lockout = min(lockout, t.policy.Max)
+	entry.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (t *lockoutTracker) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// Prune forgets keys that are neither locked nor within the failure window.
+func (t *lockoutTracker) Prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, entry := range t.entries {
+		if !now.Before(entry.lockedUntil) && now.Sub(entry.lastFailure) > t.policy.Window {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// loginGuard throttles password guessing on /login and on the account
+// endpoints that confirm the password, separately per username and per
+// client IP, so that neither one account nor one address can be
+// hammered. Its state is kept in memory and is per replica.
+type loginGuard struct {
+	users *lockoutTracker
+	ips   *lockoutTracker
+}
+
+func newLoginGuard(users LockoutPolicy, ips LockoutPolicy) *loginGuard {
+	// Hash up front so that the first login for an unknown user is not
+	// slower than the rest.
+	dummyHashOnce.Do(initDummyHash)
+	return &loginGuard{users: newLockoutTracker(users), ips: newLockoutTracker(ips)}
+}
+
+func (g *loginGuard) RetryAfter(username string, ip string, now time.Time) time.Duration {
+	return max(g.users.RetryAfter(strings.ToLower(username), now), g.ips.RetryAfter(ip, now))
+}
+
+// Fail records a failed login and returns the longest lockout it caused.
+func (g *loginGuard) Fail(username string, ip string, now time.Time) time.Duration {
+	return max(g.users.Fail(strings.ToLower(username), now), g.ips.Fail(ip, now))
+}
+
+// Succeed clears the username's failures. IP failures are kept so that an
+// attacker cannot reset them by logging into an account of their own.
+func (g *loginGuard) Succeed(username string) {
+	g.users.Reset(strings.ToLower(username))
+}
+
+func (g *loginGuard) Prune(now time.Time) {
+	g.users.Prune(now)
+	g.ips.Prune(now)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+func initDummyHash() {
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+}
+
+// comparePassword checks password against the user's hash. For unknown
+// users it compares against a dummy hash, so that the response time does not
+// reveal which usernames exist.
+func comparePassword(user User, exists bool, password string) bool {
+	if !exists {
+		dummyHashOnce.Do(initDummyHash)
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.hash), []byte(password)) == nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testLockoutPolicy = LockoutPolicy{MaxFailures: 3, Base: time.Minute, Max: 4 * time.Minute, Window: 10 * time.Minute}
+
+func TestLockoutTrackerFail(t *testing.T) {
+	type step struct {
+		at         time.Duration // since the first failure
+		fail       bool          // record a failure; otherwise only check
+		lockout    time.Duration // returned by Fail
+		retryAfter time.Duration // RetryAfter after the step
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "locked after MaxFailures",
+			steps: []step{
+				{at: 0, fail: true},
+				{at: time.Second, fail: true},
+				{at: 2 * time.Second, fail: true, lockout: time.Minute, retryAfter: time.Minute},
+				{at: 32 * time.Second, retryAfter: 30 * time.Second},
+				{at: 62 * time.Second},
+			},
+		},
+		{
+			name: "each further failure doubles up to Max",
+			steps: []step{
+				{at: 0, fail: true},
+				{at: 0, fail: true},
+				{at: 0, fail: true, lockout: time.Minute, retryAfter: time.Minute},
+				{at: time.Minute, fail: true, lockout: 2 * time.Minute, retryAfter: 2 * time.Minute},
+				{at: 3 * time.Minute, fail: true, lockout: 4 * time.Minute, retryAfter: 4 * time.Minute},
+				{at: 7 * time.Minute, fail: true, lockout: 4 * time.Minute, retryAfter: 4 * time.Minute},
+			},
+		},
+		{
+			name: "failures are forgotten after Window",
+			steps: []step{
+				{at: 0, fail: true},
+				{at: 0, fail: true},
+				{at: 10*time.Minute + time.Second, fail: true},
+				{at: 10*time.Minute + 2*time.Second, fail: true},
+				{at: 10*time.Minute + 3*time.Second, fail: true, lockout: time.Minute, retryAfter: time.Minute},
+			},
+		},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newLockoutTracker(testLockoutPolicy)
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				if s.fail {
+					if lockout := tracker.Fail("k", now); lockout != s.lockout {
+						t.Errorf("step %d: Fail = %s, want %s", i, lockout, s.lockout)
+					}
+				}
+				if wait := tracker.RetryAfter("k", now); wait != s.retryAfter {
+					t.Errorf("step %d: RetryAfter = %s, want %s", i, wait, s.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLockoutTrackerResetAndPrune(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := newLockoutTracker(testLockoutPolicy)
+	for range 3 {
+		tracker.Fail("reset", now)
+	}
+	tracker.Fail("stale", now)
+	tracker.Fail("recent", now.Add(testLockoutPolicy.Window))
+
+	tracker.Reset("reset")
+	if wait := tracker.RetryAfter("reset", now); wait != 0 {
+		t.Errorf("RetryAfter after Reset = %s, want 0", wait)
+	}
+	if lockout := tracker.Fail("reset", now); lockout != 0 {
+		t.Errorf("Fail after Reset = %s, want the count to start over", lockout)
+	}
+
+	tracker.Prune(now.Add(testLockoutPolicy.Window + time.Second))
+	if _, ok := tracker.entries["stale"]; ok {
+		t.Error("Prune kept a key outside the failure window")
+	}
+	if _, ok := tracker.entries["recent"]; !ok {
+		t.Error("Prune dropped a key within the failure window")
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ipPolicy := testLockoutPolicy
+	ipPolicy.MaxFailures = 5
+
+	t.Run("per user across addresses", func(t *testing.T) {
+		guard := newLoginGuard(testLockoutPolicy, ipPolicy)
+		guard.Fail("alice", "192.0.2.1", now)
+		guard.Fail("Alice", "192.0.2.2", now)
+		if lockout := guard.Fail("ALICE", "192.0.2.3", now); lockout != time.Minute {
+			t.Errorf("Fail = %s, want the user locked for %s", lockout, time.Minute)
+		}
+		if wait := guard.RetryAfter("alice", "198.51.100.1", now); wait != time.Minute {
+			t.Errorf("RetryAfter from a new address = %s, want %s", wait, time.Minute)
+		}
+		if wait := guard.RetryAfter("bob", "192.0.2.1", now); wait != 0 {
+			t.Errorf("RetryAfter for another user = %s, want 0", wait)
+		}
+	})
+
+	t.Run("per address across users", func(t *testing.T) {
+		guard := newLoginGuard(testLockoutPolicy, ipPolicy)
+		for _, username := range []string{"u1", "u2", "u3", "u4", "u5"} {
+			guard.Fail(username, "192.0.2.1", now)
+		}
+		if wait := guard.RetryAfter("u6", "192.0.2.1", now); wait != time.Minute {
+			t.Errorf("RetryAfter for a new user = %s, want the address locked for %s", wait, time.Minute)
+		}
+		if wait := guard.RetryAfter("u6", "192.0.2.2", now); wait != 0 {
+			t.Errorf("RetryAfter from another address = %s, want 0", wait)
+		}
+	})
+
+	t.Run("success resets the user but not the address", func(t *testing.T) {
+		guard := newLoginGuard(testLockoutPolicy, ipPolicy)
+		for range 2 {
+			guard.Fail("alice", "192.0.2.1", now)
+		}
+		guard.Succeed("Alice")
+		if lockout := guard.Fail("alice", "192.0.2.1", now); lockout != 0 {
+			t.Errorf("Fail after success = %s, want the user count to start over", lockout)
+		}
+		for range 2 {
+			guard.Fail("mallory", "192.0.2.1", now)
+		}
+		if wait := guard.RetryAfter("mallory", "192.0.2.1", now); wait != time.Minute {
+			t.Errorf("RetryAfter = %s, want the address still locked after a success from it", wait)
+		}
+	})
+}
+
+func TestLoginUserHandlerLockout(t *testing.T) {
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	guard := newLoginGuard(testLockoutPolicy, LockoutPolicy{MaxFailures: 100, Base: time.Minute, Max: time.Minute, Window: time.Minute})
+	handler := LoginUserHandler(store, newSessionAuthenticator(store, Config{}), guard, Config{})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"`+password+`"}`))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := login("password1"); w.Code != http.StatusOK {
+		t.Fatalf("login: status %d, want 200", w.Code)
+	}
+	for i := range testLockoutPolicy.MaxFailures {
+		if w := login("guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d, want 401", i, w.Code)
+		}
+	}
+	// The right password is refused while the account is locked.
+	w := login("password1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login while locked: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+}
+
+func TestComparePasswordUnknownUser(t *testing.T) {
+	newLoginGuard(testLockoutPolicy, testLockoutPolicy)
+	// Unknown users cost a bcrypt comparison as expensive as a real one.
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, %v, want %d", cost, err, bcrypt.DefaultCost)
+	}
+	if comparePassword(User{}, false, "dummy password") {
+		t.Error("comparePassword accepted the dummy password for an unknown user")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	must(t, err)
+	user := User{hash: string(hash)}
+	if !comparePassword(user, true, "password1") || comparePassword(user, true, "password2") {
+		t.Error("comparePassword does not check known users' passwords")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer cannot forward", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entry left of the proxy's", "10.1.2.3:80", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:80", []string{"198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"several header lines", "10.1.2.3:80", []string{"1.2.3.4", "198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"all hops trusted", "10.1.2.3:80", []string{"10.0.0.1"}, "10.0.0.1"},
+		{"garbage stops the walk", "10.1.2.3:80", []string{"198.51.100.1, nonsense"}, "10.1.2.3"},
+		{"trusted proxy without header", "192.168.1.1:80", nil, "192.168.1.1"},
+		{"IPv6 proxy", "[fd00::1]:80", []string{"2001:db8::5"}, "2001:db8::5"},
+		{"IPv4-mapped peer", "[::ffff:10.1.2.3]:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"unparsable remote address", "pipe", []string{"198.51.100.1"}, "pipe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveClientIP(tt.remoteAddr, tt.forwardedFor, trusted); got != tt.want {
+				t.Errorf("resolveClientIP(%q, %q) = %q, want %q", tt.remoteAddr, tt.forwardedFor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsGarbage(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/x"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	// LogLevel is "debug", "info", "warn" or "error".
+	LogLevel string
+
+	// StorageBackend is "memory", "bolt" or "postgres".
+	StorageBackend string
+	DatabaseURL    string
+	BoltPath       string
+	// RedisURL, if set, moves sessions and tasks to Redis so that replicas
+	// share them. Tasks expire RedisTaskTTL after their last update.
+	RedisURL     string
+	RedisTaskTTL time.Duration
+
+	UploadLimits     UploadLimits
+	ResultRetention  ResultRetention
+	ResultGCInterval time.Duration
+	// ResultCacheTTL is how long results are reused for identical uploads
+	// with the same filter. Zero disables the cache.
+	ResultCacheTTL time.Duration
+	// ResultCacheShared reuses results across users instead of only for
+	// the user who uploaded the image. An instant result then tells a user
+	// that someone else has processed the same image.
+	ResultCacheShared bool
+	// IdempotencyWindow is how long an Idempotency-Key keeps returning the
+	// task it created. Zero ignores the header.
+	IdempotencyWindow time.Duration
+	Quotas            Quotas
+
+	// POST /process accepts images up to ProcessMaxBytes and waits up to
+	// ProcessTimeout for the result before handing out the task ID instead.
+	ProcessMaxBytes int64
+	ProcessTimeout  time.Duration
+
+	// WorkerToken authenticates the imageProcessor on /Commit, the only
+	// way task results are written.
+	WorkerToken string
+
+	// ImageURLKey signs /img URLs; the route is disabled without it.
+	// ImageCacheMaxAge is how long clients and proxies may cache images,
+	// capped at what is left of their retention.
+	ImageURLKey      string
+	ImageCacheMaxAge time.Duration
+
+	SessionIdleTimeout     time.Duration
+	SessionAbsoluteTimeout time.Duration
+	SessionGCInterval      time.Duration
+	CookieSecure           bool
+
+	// AuthMode is "session" for server-side sessions or "jwt" for signed
+	// access tokens with refresh tokens.
+	AuthMode        string
+	JWTAlgorithm    string
+	JWTKeys         string
+	JWTSigningKeyID string
+	JWTIssuer       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	AdminUsername string
+	AdminPassword string
+
+	PasswordPolicy PasswordPolicy
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// is believed when working out client IPs for lockouts and rate limits.
+	TrustedProxies []netip.Prefix
+
+	LoginUserLockout LockoutPolicy
+	LoginIPLockout   LockoutPolicy
+
+	// RegisterRateLimit registrations per RegisterRatePeriod are allowed
+	// per client IP. Zero disables the limit.
+	RegisterRateLimit  int
+	RegisterRatePeriod time.Duration
+
+	// TaskRateLimit tasks per TaskRatePeriod may be submitted per user,
+	// counting those made with any of the user's API keys, with bursts of
+	// up to TaskRateBurst. Zero disables the limit.
+	TaskRateLimit  int
+	TaskRatePeriod time.Duration
+	TaskRateBurst  int
+}
+
+// LoadConfig reads the service configuration from environment variables,
+// falling back to defaults for anything that is not set.
+func LoadConfig() Config {
+	cfg := Config{
+		LogLevel: envString("LOG_LEVEL", "info"),
+
+		StorageBackend: envString("STORAGE_BACKEND", "memory"),
+		DatabaseURL:    os.Getenv("DATABASE_URL"),
+		BoltPath:       envString("BOLT_PATH", "storage.db"),
+		RedisURL:       os.Getenv("REDIS_URL"),
+		RedisTaskTTL:   envDuration("REDIS_TASK_TTL", 24*time.Hour),
+
+		UploadLimits: UploadLimits{
+			MaxBytes:  int64(envInt("UPLOAD_MAX_BYTES", 10<<20)),
+			MaxPixels: int64(envInt("UPLOAD_MAX_PIXELS", 40_000_000)),
+		},
+		ResultRetention: ResultRetention{
+			Default: envDuration("RESULT_TTL", 24*time.Hour),
+			Max:     envDuration("RESULT_MAX_TTL", 7*24*time.Hour),
+		},
+		ResultGCInterval:  envDuration("RESULT_GC_INTERVAL", time.Minute),
+		ResultCacheTTL:    envDuration("RESULT_CACHE_TTL", 24*time.Hour),
+		ResultCacheShared: envBool("RESULT_CACHE_SHARED", false),
+		IdempotencyWindow: envDuration("IDEMPOTENCY_WINDOW", 24*time.Hour),
+		Quotas: Quotas{
+			Daily:   envQuota("QUOTA_DAILY_"),
+			Monthly: envQuota("QUOTA_MONTHLY_"),
+		},
+
+		ProcessMaxBytes: int64(envInt("PROCESS_MAX_BYTES", 512<<10)),
+		ProcessTimeout:  envDuration("PROCESS_TIMEOUT", 10*time.Second),
+
+		WorkerToken: os.Getenv("WORKER_TOKEN"),
+
+		ImageURLKey:      os.Getenv("IMAGE_URL_KEY"),
+		ImageCacheMaxAge: envDuration("IMAGE_CACHE_MAX_AGE", 7*24*time.Hour),
+
+		SessionIdleTimeout:     envDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		SessionAbsoluteTimeout: envDuration("SESSION_ABSOLUTE_TIMEOUT", 24*time.Hour),
+		SessionGCInterval:      envDuration("SESSION_GC_INTERVAL", time.Minute),
+		CookieSecure:           envBool("COOKIE_SECURE", false),
+
+		AuthMode:        envString("AUTH_MODE", "session"),
+		JWTAlgorithm:    envString("JWT_ALGORITHM", "HS256"),
+		JWTKeys:         os.Getenv("JWT_KEYS"),
+		JWTSigningKeyID: os.Getenv("JWT_SIGNING_KEY_ID"),
+		JWTIssuer:       envString("JWT_ISSUER", "task-service"),
+		AccessTokenTTL:  envDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+
+		AdminUsername: os.Getenv("ADMIN_USERNAME"),
+		AdminPassword: os.Getenv("ADMIN_PASSWORD"),
+
+		PasswordPolicy: PasswordPolicy{
+			MinLength:      envInt("PASSWORD_MIN_LENGTH", 8),
+			RequireLetter:  envBool("PASSWORD_REQUIRE_LETTER", true),
+			RequireDigit:   envBool("PASSWORD_REQUIRE_DIGIT", true),
+			RequireSpecial: envBool("PASSWORD_REQUIRE_SPECIAL", false),
+		},
+
+		TrustedProxies: envTrustedProxies("TRUSTED_PROXIES"),
+
+		LoginUserLockout: LockoutPolicy{
+			MaxFailures: envInt("LOGIN_USER_MAX_FAILURES", 5),
+			Base:        envDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+			Max:         envDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+			Window:      envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		},
+		LoginIPLockout: LockoutPolicy{
+			MaxFailures: envInt("LOGIN_IP_MAX_FAILURES", 20),
+			Base:        envDuration("LOGIN_LOCKOUT_BASE", 30*time.Second),
+			Max:         envDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+			Window:      envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		},
+		RegisterRateLimit:  envInt("REGISTER_RATE_LIMIT", 10),
+		RegisterRatePeriod: envDuration("REGISTER_RATE_PERIOD", time.Hour),
+
+		TaskRateLimit:  envInt("TASK_RATE_LIMIT", 60),
+		TaskRatePeriod: envDuration("TASK_RATE_PERIOD", time.Minute),
+		TaskRateBurst:  envInt("TASK_RATE_BURST", 10),
+	}
+	failOnError(cfg.validate(), "Invalid configuration")
+	return cfg
+}
+
+// validate rejects settings that parse but make no sense together.
+func (c Config) validate() error {
+	if c.WorkerToken == "" {
+		return fmt.Errorf("WORKER_TOKEN must be set")
+	}
+	limits := []struct {
+		name   string
+		limit  int
+		period time.Duration
+	}{
+		{"REGISTER_RATE", c.RegisterRateLimit, c.RegisterRatePeriod},
+		{"TASK_RATE", c.TaskRateLimit, c.TaskRatePeriod},
+	}
+	for _, l := range limits {
+		if l.limit < 0 {
+			return fmt.Errorf("%s_LIMIT must not be negative", l.name)
+		}
+		if l.limit > 0 && l.period <= 0 {
+			return fmt.Errorf("%s_PERIOD must be positive", l.name)
+		}
+	}
+	if c.TaskRateBurst < 0 {
+		return fmt.Errorf("TASK_RATE_BURST must not be negative")
+	}
+	// Both drive a time.Ticker, which panics on non-positive intervals.
+	if c.SessionGCInterval <= 0 {
+		return fmt.Errorf("SESSION_GC_INTERVAL must be positive")
+	}
+	if c.ResultGCInterval <= 0 {
+		return fmt.Errorf("RESULT_GC_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// envQuota reads the TASKS, INPUT_BYTES, OUTPUT_BYTES and CPU_TIME limits
+// with the given prefix. Unset limits are unlimited.
+func envQuota(prefix string) Quota {
+	return Quota{
+		Tasks:       int64(envInt(prefix+"TASKS", 0)),
+		InputBytes:  int64(envInt(prefix+"INPUT_BYTES", 0)),
+		OutputBytes: int64(envInt(prefix+"OUTPUT_BYTES", 0)),
+		CPUTime:     envDuration(prefix+"CPU_TIME", 0),
+	}
+}
+
+func envTrustedProxies(key string) []netip.Prefix {
+	prefixes, err := parseTrustedProxies(os.Getenv(key))
+	failOnError(err, "Invalid "+key)
+	return prefixes
+}
+
+func envString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	failOnError(err, "Invalid duration in "+key)
+	return d
+}
+
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	failOnError(err, "Invalid integer in "+key)
+	return i
+}
+
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	failOnError(err, "Invalid boolean in "+key)
+	return b
+}
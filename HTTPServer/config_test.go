@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{WorkerToken: "secret", SessionGCInterval: time.Minute, ResultGCInterval: time.Minute}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("validate = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"no worker token", func(c *Config) { c.WorkerToken = "" }, "WORKER_TOKEN"},
+		{"zero session GC interval", func(c *Config) { c.SessionGCInterval = 0 }, "SESSION_GC_INTERVAL"},
+		{"negative session GC interval", func(c *Config) { c.SessionGCInterval = -time.Second }, "SESSION_GC_INTERVAL"},
+		{"zero result GC interval", func(c *Config) { c.ResultGCInterval = 0 }, "RESULT_GC_INTERVAL"},
+		{"negative task rate limit", func(c *Config) { c.TaskRateLimit = -1 }, "TASK_RATE_LIMIT"},
+		{"task rate without a period", func(c *Config) { c.TaskRateLimit = 1 }, "TASK_RATE_PERIOD"},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.modify(&c)
+		if err := c.validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: validate = %v, want an error about %s", tt.name, err, tt.want)
+		}
+	}
+}
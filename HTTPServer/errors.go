@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+)
+
+// ErrorResponse is the body of every error response. Code is a stable
+// machine-readable identifier; Message is meant for humans.
+type ErrorResponse struct {
+	Code      string `json:"code" example:"not_found"`
+	Message   string `json:"message" example:"Not found"`
+	RequestID string `json:"request_id" example:"3f0c8a5e-2b1d-4c7e-9a4f-6d2e8b1c0a9f"`
+}
+
+// writeError sends an ErrorResponse with the given status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFromContext(r.Context()),
+	})
+}
+
+// writeStorageError responds to an error from storage or an Authenticator:
+// 404 for missing records, 409 for taken usernames, 503 when the storage
+// backend fails and 500 for anything else.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	var storageErr *StorageError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", "Not found")
+	case errors.Is(err, ErrUserExists):
+		writeError(w, r, http.StatusConflict, "user_exists", err.Error())
+	case errors.As(err, &storageErr):
+		loggerFromContext(r.Context()).Error("Storage unavailable", "method", r.Method, "path", r.URL.Path, "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "storage_unavailable", "Storage unavailable")
+	default:
+		loggerFromContext(r.Context()).Error("Internal error", "method", r.Method, "path", r.URL.Path, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+	}
+}
+
+const (
+	requestIDHeader     = "X-Request-ID"
+	requestIDContextKey = contextKey("request_id")
+)
+
+// requestIDMiddleware gives every request an ID, echoed in the X-Request-ID
+// response header and in error responses. A well-formed ID sent by the
+// client or a proxy is kept so that logs can be correlated.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// recoverMiddleware turns a panic in a handler into a 500 response so that
+// one bad request cannot take the server down.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate abort of the response; net/http handles it.
+				panic(recovered)
+			}
+			loggerFromContext(r.Context()).Error("Panic serving request",
+				"method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "not_found", "Not found")
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
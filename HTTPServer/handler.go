@@ -3,21 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"image"
-	"image/png"
-	"io"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type TaskResponse struct {
@@ -26,6 +27,11 @@ type TaskResponse struct {
 
 type StatusResponse struct {
 	Status string `json:"status"`
+	// ExpiresAt is when the result will be deleted, once the task is ready.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ImageKey is the sourceKey of /img URLs for the result, once the
+	// task is ready and image URLs are enabled.
+	ImageKey string `json:"image_key,omitempty"`
 }
 
 type ImageFilterMessage struct {
@@ -40,131 +46,381 @@ type ImageRequest struct {
 }
 
 // @Summary Submit a new task
+// @Description Accepts PNG, JPEG and GIF images up to UPLOAD_MAX_BYTES and UPLOAD_MAX_PIXELS. The type is detected from the file contents.
 // @Accept multipart/form-data
 // @Produce json
-// @Param Authorization header string true "Auth token"
+// @Security BearerAuth
 // @Param image formData file true "Image file"
 // @Param filtername formData string true "Name of the filter"
+// @Param retention formData string false "How long to keep the result after completion, e.g. 2h; defaults to RESULT_TTL"
+// @Param Idempotency-Key header string false "Retries with the same key within IDEMPOTENCY_WINDOW return the original task"
 // @Success 200 {object} TaskResponse
-// @Failure 401 {string} string "Invalid token"
+// @Header 200 {string} Idempotent-Replayed "true if the task was created by an earlier request with the same Idempotency-Key"
+// @Failure 400 {object} ErrorResponse "Invalid form, image, retention or Idempotency-Key"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Missing scope tasks:write"
+// @Failure 409 {object} ErrorResponse "A request with the same Idempotency-Key is in progress"
+// @Failure 413 {object} ErrorResponse "Image too large"
+// @Failure 415 {object} ErrorResponse "Unsupported image type"
+// @Failure 422 {object} ErrorResponse "Idempotency-Key was used for a different request"
+// @Failure 429 {object} ErrorResponse "Too many tasks, or daily or monthly quota exceeded"
+// @Failure 503 {object} ErrorResponse "Storage or queue unavailable"
 // @Router /task [post]
-func CreateTaskHandler(ch *amqp.Channel, store Storage) http.HandlerFunc {
+func CreateTaskHandler(ch taskQueue, tasks TaskStore, usage UsageStore, idempotency IdempotencyStore, cache ResultCacheStore, cfg Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseMultipartForm(10 << 20)
-		failOnError(err, "Failed to parse multipart form")
+		task, ok := submitTask(w, r, ch, tasks, usage, idempotency, cache, cfg, cfg.UploadLimits)
+		if !ok {
+			return
+		}
+		json.NewEncoder(w).Encode(TaskResponse{TaskID: task.Id})
+	}
+}
 
-		file, _, err := r.FormFile("image")
-		failOnError(err, "Failed to get image file")
-		defer file.Close()
+// submitTask validates the uploaded image against limits, reserves its quota,
+// stores the task and queues it for the imageProcessor. On failure it has
+// already written the error response and returns false.
+func submitTask(w http.ResponseWriter, r *http.Request, ch taskQueue, tasks TaskStore, usage UsageStore, idempotency IdempotencyStore, cache ResultCacheStore, cfg Config, limits UploadLimits) (Task, bool) {
+	imageBytes, err := readUpload(w, r, limits)
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		message := uploadErr.message
+		// /task accepts more bytes, but not more pixels.
+		if uploadErr.code == "image_too_large" && limits.MaxBytes < cfg.UploadLimits.MaxBytes {
+			message += "; use POST /task for larger images"
+		}
+		writeError(w, r, uploadErr.status, uploadErr.code, message)
+		return Task{}, false
+	}
+
+	filterName := normalizePipeline(r.FormValue("filtername"))
 
-		imageBytes, err := io.ReadAll(file)
-		failOnError(err, "Failed to read image file")
+	resultTTL, err := cfg.ResultRetention.TTL(r.FormValue("retention"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+		return Task{}, false
+	}
 
-		imageBase64 := base64.StdEncoding.EncodeToString(imageBytes)
+	now := time.Now()
+	userID := identityFromContext(r.Context()).UserId
+	task := Task{
+		Id:          uuid.New().String(),
+		UserId:      userID,
+		FilterName:  filterName,
+		CreatedAt:   now,
+		Status:      "in_progress",
+		ResultTTL:   resultTTL,
+		ContentHash: contentHash(resultCacheScope(cfg, userID), filterName, imageBytes),
+	}
 
-		filterName := r.FormValue("filtername")
+	original, release, ok := claimIdempotencyKey(w, r, idempotency, tasks, cfg.IdempotencyWindow, task)
+	if !ok {
+		return Task{}, false
+	}
+	if original.Id != "" {
+		return original, true
+	}
 
-		taskID := uuid.New().String()
-		store.SetTask(taskID, Task{Status: "in_progress"})
+	var quotaErr *quotaError
+	releaseUsage, err := reserveQuota(r.Context(), identityFromContext(r.Context()), usage, cfg.Quotas, int64(len(imageBytes)), now)
+	if errors.As(err, &quotaErr) {
+		release()
+		setRetryAfter(w, quotaErr.reset.Sub(now))
+		writeError(w, r, http.StatusTooManyRequests, "quota_exceeded", quotaErr.Error())
+		return Task{}, false
+	}
+	if err != nil {
+		release()
+		writeStorageError(w, r, err)
+		return Task{}, false
+	}
+	// From here on, a failed submission gives back the key and the usage.
+	releaseKey := release
+	release = func() {
+		releaseUsage()
+		releaseKey()
+	}
 
-		message := ImageFilterMessage{
-			TaskId:      taskID,
-			ImageBase64: imageBase64,
-			FilterName:  filterName,
+	if cfg.ResultCacheTTL > 0 {
+		cached, ok, err := cachedResult(r.Context(), cache, task.ContentHash, now)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("Failed to look up cached result", "task_id", task.Id, "error", err)
+		}
+		if ok {
+			task, ok := submitCachedTask(w, r, tasks, usage, task, cached)
+			if !ok {
+				release()
+			}
+			return task, ok
 		}
+	}
+	if err := tasks.SetTask(r.Context(), task); err != nil {
+		release()
+		writeStorageError(w, r, err)
+		return Task{}, false
+	}
 
-		messageBytes, err := json.Marshal(message)
-		failOnError(err, "Failed to marshal message to JSON")
+	err = publishTask(r.Context(), ch, ImageFilterMessage{
+		TaskId:      task.Id,
+		ImageBase64: base64.StdEncoding.EncodeToString(imageBytes),
+		FilterName:  filterName,
+	})
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to publish task", "task_id", task.Id, "error", err)
+		release()
+		task.Status = "failed"
+		if err := tasks.SetTask(context.WithoutCancel(r.Context()), task); err != nil {
+			loggerFromContext(r.Context()).Error("Failed to mark task as failed", "task_id", task.Id, "error", err)
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "queue_unavailable", "Queue unavailable")
+		return Task{}, false
+	}
+	loggerFromContext(r.Context()).Info("Task queued", "task_id", task.Id, "filter", task.FilterName, "input_bytes", len(imageBytes))
+	tasksCreatedTotal.WithLabelValues(filterLabel(task.FilterName), "false").Inc()
+	return task, true
+}
 
-		q, err := ch.QueueDeclare(
-			"code", // name
-			false,  // durable
-			false,  // delete when unused
-			false,  // exclusive
-			false,  // no-wait
-			nil,    // arguments
-		)
-		failOnError(err, "Failed to declare a queue")
+// submitCachedTask stores the task as completed with the cached result
+// instead of queueing it and adds the result to the output usage. On
+// failure it has already written the error response and returns false.
+func submitCachedTask(w http.ResponseWriter, r *http.Request, tasks TaskStore, usage UsageStore, task Task, cached CachedResult) (Task, bool) {
+	task.Status = "ready"
+	task.Result = cached.Result
+	task = completeTask(task, task.CreatedAt)
+	if err := tasks.SetTask(r.Context(), task); err != nil {
+		writeStorageError(w, r, err)
+		return Task{}, false
+	}
+	loggerFromContext(r.Context()).Info("Task served from the result cache", "task_id", task.Id, "filter", task.FilterName)
+	tasksCreatedTotal.WithLabelValues(filterLabel(task.FilterName), "true").Inc()
+
+	delta := Usage{OutputBytes: int64(base64.StdEncoding.DecodedLen(len(task.Result)))}
+	if err := usage.AddUsage(r.Context(), task.UserId, task.CreatedAt, delta); err != nil {
+		loggerFromContext(r.Context()).Error("Failed to record usage", "task_id", task.Id, "error", err)
+	}
+	return task, true
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+// taskQueue is the part of *amqp.Channel that tasks are submitted through.
+type taskQueue interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
 
-		err = ch.PublishWithContext(
-			ctx,
-			"",     // exchange
-			q.Name, // routing key
-			false,  // mandatory
-			false,  // immediate
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        messageBytes,
-			})
-		failOnError(err, "Failed to publish a message")
-		log.Printf(" [x] Sent %s\n", message.TaskId)
+// publishTask sends the message to the imageProcessor's queue.
+func publishTask(ctx context.Context, ch taskQueue, message ImageFilterMessage) error {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
 
-		json.NewEncoder(w).Encode(TaskResponse{TaskID: taskID})
+	q, err := declareTaskQueue(ch)
+	if err != nil {
+		return err
 	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return ch.PublishWithContext(
+		ctx,
+		"",     // exchange
+		q.Name, // routing key
+		false,  // mandatory
+		false,  // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			// The worker logs the request ID and sends it back on commit,
+			// so that a task can be followed across both services.
+			Headers: amqp.Table{requestIDHeader: requestIDFromContext(ctx)},
+			Body:    messageBytes,
+		})
+}
+
+// declareTaskQueue declares the queue the imageProcessor consumes from. The
+// parameters must match the consumer's declaration.
+func declareTaskQueue(ch taskQueue) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		"code", // name
+		false,  // durable
+		false,  // delete when unused
+		false,  // exclusive
+		false,  // no-wait
+		nil,    // arguments
+	)
+}
+
+// canAccessTask reports whether the identity may see the task. Admins can
+// see every task.
+func canAccessTask(identity Identity, task Task) bool {
+	return task.UserId == identity.UserId || identity.Role == RoleAdmin
 }
 
 // @Summary Get task status
 // @Produce json
 // @Param taskID path string true "Task ID"
-// @Param Authorization header string true "Auth token"
+// @Security BearerAuth
 // @Success 200 {object} StatusResponse
-// @Failure 401 {string} string "Invalid token"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Missing scope tasks:read"
+// @Failure 404 {object} ErrorResponse "not found"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
 // @Router /status/{taskID} [get]
-func GetStatusHandler(ch *amqp.Channel, store Storage) http.HandlerFunc {
+func GetStatusHandler(ch *amqp.Channel, tasks TaskStore, cfg Config) http.HandlerFunc {
+	imageKeys := newImageURLKeys(cfg.ImageURLKey)
 	return func(w http.ResponseWriter, r *http.Request) {
-		taskID := chi.URLParam(r, "taskID")
-		task, ok := store.GetTask(taskID)
-		if !ok {
-			http.NotFound(w, r)
+		task, err := tasks.GetTask(r.Context(), chi.URLParam(r, "taskID"))
+		if err == nil && !canAccessTask(identityFromContext(r.Context()), task) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(StatusResponse{Status: task.Status})
+		response := StatusResponse{Status: task.Status}
+		if task.ResultExpired(time.Now()) {
+			response.Status = "expired"
+		} else if !task.ExpiresAt.IsZero() {
+			response.ExpiresAt = &task.ExpiresAt
+		}
+		if cfg.ImageURLKey != "" && response.Status == "ready" {
+			response.ImageKey, _ = imageKeys.sourceKey(task.Id)
+		}
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
 // @Summary Get task result
+// @Description Serves the stored image as is. Supports conditional requests with If-None-Match and If-Modified-Since, and Range requests.
 // @Param taskID path string true "Task ID"
-// @Param Authorization header string true "Auth token"
+// @Param Range header string false "Byte range, e.g. bytes=0-1023"
+// @Security BearerAuth
 // @Produce image/png
 // @Success 200 {file} file "Logo image in PNG format"
-// @Failure 404 {string} string "not found"
-// @Failure 401 {string} string "Invalid token"
+// @Success 206 {file} file "Requested range of the image"
+// @Success 304 "Not modified"
+// @Header 200,206,304 {string} ETag "Hash of the image"
+// @Header 200,206,304 {string} Last-Modified "When the task completed"
+// @Failure 404 {object} ErrorResponse "not found"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Missing scope tasks:read"
+// @Failure 410 {object} ErrorResponse "Result expired"
+// @Failure 416 "Range not satisfiable"
+// @Failure 422 {object} ErrorResponse "Processing failed"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
 // @Router /result/{taskID} [get]
-func GetResultHandler(ch *amqp.Channel, store Storage) http.HandlerFunc {
+func GetResultHandler(ch *amqp.Channel, tasks TaskStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		taskID := chi.URLParam(r, "taskID")
-		task, ok := store.GetTask(taskID)
-		if !ok || task.Status != "ready" {
-			http.NotFound(w, r)
+		task, err := tasks.GetTask(r.Context(), chi.URLParam(r, "taskID"))
+		if err == nil && !canAccessTask(identityFromContext(r.Context()), task) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
 			return
 		}
-
-		commaIndex := strings.Index(task.Result, ",")
-		if commaIndex != -1 {
-			task.Result = task.Result[commaIndex+1:]
+		// Results are private and unchanging, but must not outlive their
+		// retention in caches.
+		if task.ExpiresAt.IsZero() {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		} else if maxAge := int(time.Until(task.ExpiresAt).Seconds()); maxAge > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
 		}
+		writeResult(w, r, task)
+	}
+}
 
-		data, err := base64.StdEncoding.DecodeString(task.Result)
-		if err != nil {
-			log.Fatalf("Ошибка декодирования base64: %v", err)
-		}
+// writeResult sends the task's result as PNG, or the error explaining why
+// there is none.
+func writeResult(w http.ResponseWriter, r *http.Request, task Task) {
+	if task.ResultExpired(time.Now()) {
+		writeError(w, r, http.StatusGone, "result_expired", "Result expired")
+		return
+	}
+	if task.Status == "failed" {
+		writeError(w, r, http.StatusUnprocessableEntity, "task_failed", "Processing failed")
+		return
+	}
+	if task.Status != "ready" {
+		writeError(w, r, http.StatusNotFound, "not_ready", "Result is not ready")
+		return
+	}
 
-		img, _, err := image.Decode(bytes.NewReader(data))
-		if err != nil {
-			log.Fatalf("Ошибка декодирования изображения: %v", err)
-		}
+	// Results never change, so their hash, taken once on completion,
+	// makes a strong ETag. Callers may set their own.
+	etag := w.Header().Get("ETag")
+	if etag == "" && task.ResultETag != "" {
+		etag = task.ResultETag
+		w.Header().Set("ETag", etag)
+	}
+	modTime := resultModTime(task)
+	// Revalidations are answered without decoding the result.
+	if resultNotModified(r, etag, modTime) {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-		w.Header().Set("Content-Type", "image/png")
-		err = png.Encode(w, img)
-		if err != nil {
-			http.Error(w, "Failed to encode image", http.StatusInternalServerError)
+	data, err := decodeResult(task.Result)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Corrupt result", "task_id", task.Id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "corrupt_result", "Failed to decode the result")
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	// ServeContent answers the remaining conditional and Range requests
+	// and sets Content-Length.
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
+
+// decodeResult returns the image bytes of a result, which the worker sends
+// as base64, optionally as a data URL.
+func decodeResult(result string) ([]byte, error) {
+	if commaIndex := strings.Index(result, ","); commaIndex != -1 {
+		result = result[commaIndex+1:]
+	}
+	return base64.StdEncoding.DecodeString(result)
+}
+
+// resultETag is the strong ETag of a result, or "" if it does not decode.
+func resultETag(result string) string {
+	data, err := decodeResult(result)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// resultNotModified reports whether a GET or HEAD can be answered with 304:
+// If-None-Match lists etag, or, without If-None-Match, the result has not
+// changed since If-Modified-Since.
+func resultNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(header, ",") {
+			// If-None-Match uses the weak comparison.
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
 		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
 
-		w.Write([]byte(task.Result))
+// resultModTime is the Last-Modified time of the task's result.
+func resultModTime(task Task) time.Time {
+	if !task.CompletedAt.IsZero() {
+		return task.CompletedAt
 	}
+	return task.CreatedAt
 }
 
 type AuthUserRequest struct {
@@ -179,15 +435,25 @@ type AuthUserRequest struct {
 // @Produce plain
 // @Param user body AuthUserRequest true "User data"
 // @Success      201   {string}  string  "User successfully registered"
-// @Failure      400   {string}  string  "Invalid input or missing fields"
-// @Failure      500   {string}  string  "Internal server error"
+// @Failure      400   {object} ErrorResponse  "Invalid input or missing fields"
+// @Failure      409   {object} ErrorResponse  "User already exists"
+// @Failure      429   {object} ErrorResponse  "Too many registrations"
+// @Failure      500   {object} ErrorResponse  "Internal server error"
+// @Failure      503   {object} ErrorResponse  "Storage unavailable"
 // @Router       /register [post]
-func RegisterUserHandler(store Storage) http.HandlerFunc {
+func RegisterUserHandler(users UserStore, policy PasswordPolicy, limiter *rateLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.Allow(clientIP(r), time.Now()); !ok {
+			audit(r, "register_throttled")
+			setRetryAfter(w, wait)
+			writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many registrations")
+			return
+		}
+
 		userID := uuid.New().String()
 		var data AuthUserRequest
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
@@ -195,67 +461,315 @@ func RegisterUserHandler(store Storage) http.HandlerFunc {
 		password := data.Password
 
 		if username == "" || password == "" {
-			http.Error(w, "Missing username or password", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "Missing username or password")
+			return
+		}
+		if err := validateUsername(username); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if err := policy.Validate(username, password); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
 		}
 
-		if err := store.RegisterUser(userID, username, password); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := users.RegisterUser(r.Context(), userID, username, password); err != nil {
+			writeStorageError(w, r, err)
 			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
-
 	}
 }
 
+type TokenResponse struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type" example:"Bearer"`
+	ExpiresIn    int64     `json:"expires_in" example:"86400"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+const sessionCookieName = "session_id"
+
 // @Summary Login user
+// @Description Returns an access token to be sent as "Authorization: Bearer <token>". The same token is also set as an HttpOnly session cookie. With AUTH_MODE=jwt the response also carries a refresh token for /token/refresh.
 // @tags auth
 // @Accept json
-// @Produce plain
+// @Produce json
 // @Param user body AuthUserRequest true "User data"
-// @Success      200   {string}  string  "User successfully logined"
-// @Failure      401   {string}  string  "Invalid username or password"
+// @Success      200   {object}  TokenResponse
+// @Failure      401   {object} ErrorResponse  "Invalid username or password"
+// @Failure      403   {object} ErrorResponse  "Account disabled"
+// @Failure      429   {object} ErrorResponse  "Too many failed login attempts"
+// @Failure      503   {object} ErrorResponse  "Storage unavailable"
 // @Router       /login [post]
-func LoginUserHandler(store Storage) http.HandlerFunc {
+func LoginUserHandler(users UserStore, auth Authenticator, guard *loginGuard, cfg Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var data AuthUserRequest
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
 			return
 		}
 
-		SessionId := uuid.New().String()
-		User, exists := store.GetUserByLogin(data.Username)
+		ip := clientIP(r)
+		if wait := guard.RetryAfter(data.Username, ip, time.Now()); wait > 0 {
+			audit(r, "login_throttled", "username", data.Username)
+			setRetryAfter(w, wait)
+			writeError(w, r, http.StatusTooManyRequests, "login_locked", "Too many failed login attempts")
+			return
+		}
 
-		if !exists || bcrypt.CompareHashAndPassword([]byte(User.hash), []byte(data.Password)) != nil {
-			http.Error(w, "Invalid username or password", http.StatusBadRequest)
+		User, err := users.GetUserByLogin(r.Context(), data.Username)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			writeStorageError(w, r, err)
 			return
 		}
+		exists := err == nil
 
-		Session := Session{UserId: User.id,
-			SessionId: SessionId}
-		store.SetSession(Session)
+		if !comparePassword(User, exists, data.Password) {
+			reason := "bad_password"
+			if !exists {
+				reason = "unknown_user"
+			}
+			audit(r, "login_failed", "username", data.Username, "reason", reason)
+			if lockout := guard.Fail(data.Username, ip, time.Now()); lockout > 0 {
+				audit(r, "login_locked", "username", data.Username, "duration", lockout.String())
+			}
+			writeError(w, r, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password")
+			return
+		}
+		guard.Succeed(data.Username)
+		if User.disabled {
+			writeError(w, r, http.StatusForbidden, "account_disabled", "Account disabled")
+			return
+		}
 
-		w.Header().Add("Authorization", SessionId)
-		w.WriteHeader(http.StatusOK)
+		response, err := auth.Issue(User, r)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		writeTokenResponse(w, cfg, response)
+	}
+}
+
+// writeTokenResponse sends the token as JSON and mirrors the access token in
+// the session cookie for browser clients.
+func writeTokenResponse(w http.ResponseWriter, cfg Config, response TokenResponse) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    response.AccessToken,
+		Path:     "/",
+		Expires:  response.ExpiresAt,
+		HttpOnly: true,
+		Secure:   cfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// tokenFromRequest extracts the session token from the Authorization header,
+// accepting both "Bearer <token>" and a bare token, and falls back to the
+// session cookie.
+func tokenFromRequest(r *http.Request) string {
+	if header := strings.TrimSpace(r.Header.Get("Authorization")); header != "" {
+		if scheme, token, found := strings.Cut(header, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return header
 	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
 }
 
-func authMiddleware(store Storage) func(next http.Handler) http.Handler {
+func authMiddleware(users UserStore, auth Authenticator) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token := r.Header.Get("Authorization")
-			if token == "" {
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
+			identity, err := Identity{}, errInvalidToken
+			if key := r.Header.Get(apiKeyHeader); key != "" {
+				identity, err = authenticateAPIKey(r.Context(), users, key)
+			} else if token := tokenFromRequest(r); strings.HasPrefix(token, apiKeyPrefix) {
+				identity, err = authenticateAPIKey(r.Context(), users, token)
+			} else if token != "" {
+				identity, err = auth.Authenticate(r.Context(), token)
+			}
+			if errors.Is(err, errInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid token")
 				return
 			}
-			if len(token) <= len("Bearer ") {
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
+			if err != nil {
+				writeStorageError(w, r, err)
 				return
 			}
-			_, exists := store.GetSession(token[len("Bearer "):])
-			if !exists {
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
+
+			ctx := context.WithValue(r.Context(), identityContextKey, identity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requireScope rejects requests whose credentials were not granted scope.
+func requireScope(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !identityFromContext(r.Context()).HasScope(scope) {
+				writeError(w, r, http.StatusForbidden, "missing_scope", "Missing scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireRole rejects requests from users that do not have the role.
+func requireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if identityFromContext(r.Context()).Role != role {
+				writeError(w, r, http.StatusForbidden, "forbidden", "Forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession rejects requests that were not authenticated with a login
+// session, e.g. account management attempted with an API key.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identityFromContext(r.Context()).SessionId == "" {
+			writeError(w, r, http.StatusForbidden, "session_required", "This endpoint requires a login session")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Identity describes who made an authenticated request.
+type Identity struct {
+	UserId    string
+	Role      string
+	SessionId string
+	APIKeyId  string
+	// Scopes limits what an API key may do; sessions are not restricted.
+	Scopes []string
+}
+
+func (i Identity) HasScope(scope string) bool {
+	if i.APIKeyId == "" {
+		return true
+	}
+	return slices.Contains(i.Scopes, scope)
+}
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+// identityFromContext returns the identity attached by authMiddleware.
+func identityFromContext(ctx context.Context) Identity {
+	identity, _ := ctx.Value(identityContextKey).(Identity)
+	return identity
+}
+
+type SessionResponse struct {
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// @Summary Logout
+// @Description Revokes the session used to authenticate this request
+// @tags auth
+// @Security BearerAuth
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /logout [post]
+func LogoutHandler(auth Authenticator, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.Revoke(r.Context(), identityFromContext(r.Context())); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		clearSessionCookie(w, cfg)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func clearSessionCookie(w http.ResponseWriter, cfg Config) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cfg.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// @Summary List active sessions
+// @tags auth
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} SessionResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /sessions [get]
+func ListSessionsHandler(auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := auth.Sessions(r.Context(), identityFromContext(r.Context()))
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+		})
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// @Summary Revoke other sessions
+// @Description Revokes every session of the current user except the one used for this request
+// @tags auth
+// @Security BearerAuth
+// @Success 204
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /sessions/revoke-others [post]
+func RevokeOtherSessionsHandler(auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.RevokeOthers(r.Context(), identityFromContext(r.Context())); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// requireWorker admits only requests that carry the worker token, so that
+// clients cannot write task results themselves.
+func requireWorker(token string) func(next http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Comparing hashes keeps the comparison constant-time even
+			// for tokens of a different length.
+			got := sha256.Sum256([]byte(tokenFromRequest(r)))
+			if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				writeError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid worker token")
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -267,18 +781,62 @@ type CommitRequest struct {
 	Id     string
 	Result string
 	Status string
+	// CPUTimeUs is the CPU time the worker spent on the task, in
+	// microseconds.
+	CPUTimeUs int64
 }
 
-func CommitHandler(store Storage) http.HandlerFunc {
+func CommitHandler(tasks TaskStore, usage UsageStore, cache ResultCacheStore, waiter *taskWaiter, cfg Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var data CommitRequest
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		if data.Status != "ready" && data.Status != "failed" {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", "Status must be ready or failed")
 			return
 		}
 
-		store.SetTask(data.Id, Task{Status: data.Status, Result: data.Result})
-		log.Printf("%s %s %s", data.Id, data.Status, data.Result)
+		task, err := tasks.GetTask(r.Context(), data.Id)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		// Only the outcome of a queued task is accepted; a completed
+		// task, and its result in the cache, is never overwritten.
+		if task.Status != "in_progress" {
+			writeError(w, r, http.StatusConflict, "task_not_in_progress", "Task is not in progress")
+			return
+		}
+		task.Status = data.Status
+		task.Result = data.Result
+		now := time.Now()
+		if task.Status == "ready" {
+			task = completeTask(task, now)
+		}
+		if err := tasks.SetTask(r.Context(), task); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		waiter.Notify(task.Id)
+		tasksCompletedTotal.WithLabelValues(statusLabel(task.Status)).Inc()
+		if task.Status == "ready" && task.ContentHash != "" && cfg.ResultCacheTTL > 0 {
+			if err := cacheResult(r.Context(), cache, task, cfg.ResultCacheTTL, now); err != nil {
+				loggerFromContext(r.Context()).Error("Failed to cache the result", "task_id", task.Id, "error", err)
+			}
+		}
+		if task.UserId != "" {
+			delta := Usage{
+				OutputBytes: int64(base64.StdEncoding.DecodedLen(len(data.Result))),
+				CPUTime:     time.Duration(data.CPUTimeUs) * time.Microsecond,
+			}
+			if err := usage.AddUsage(r.Context(), task.UserId, now, delta); err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+		}
+		loggerFromContext(r.Context()).Info("Task committed", "task_id", data.Id, "status", data.Status, "cpu_time_us", data.CPUTimeUs)
 		w.WriteHeader(http.StatusOK)
 	}
 }
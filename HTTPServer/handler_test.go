@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCommitHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	cfg := Config{WorkerToken: "worker-secret", ResultCacheTTL: time.Hour}
+	handler := requireWorker(cfg.WorkerToken)(CommitHandler(store, store, store, newTaskWaiter(), cfg))
+	mustRegister(t, store, "u1", "alice")
+	must(t, store.SetTask(ctx, Task{Id: "t1", UserId: "u1", Status: "in_progress", CreatedAt: time.Now(), ContentHash: "h1"}))
+
+	commit := func(token string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/Commit", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		code  int
+	}{
+		{"no token", "", `{"id":"t1","status":"ready","result":"Zm9yZ2Vk"}`, http.StatusUnauthorized},
+		{"wrong token", "guess", `{"id":"t1","status":"ready","result":"Zm9yZ2Vk"}`, http.StatusUnauthorized},
+		{"unknown status", cfg.WorkerToken, `{"id":"t1","status":"in_progress"}`, http.StatusBadRequest},
+		{"unknown task", cfg.WorkerToken, `{"id":"t2","status":"ready"}`, http.StatusNotFound},
+		{"worker result", cfg.WorkerToken, `{"id":"t1","status":"ready","result":"cmVhbA=="}`, http.StatusOK},
+		{"overwrite of a ready task", cfg.WorkerToken, `{"id":"t1","status":"ready","result":"Zm9yZ2Vk"}`, http.StatusConflict},
+		{"failure after success", cfg.WorkerToken, `{"id":"t1","status":"failed"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if code := commit(tt.token, tt.body); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	task, err := store.GetTask(ctx, "t1")
+	must(t, err)
+	if task.Status != "ready" || task.Result != "cmVhbA==" {
+		t.Errorf("task = %s %q, want the worker's result", task.Status, task.Result)
+	}
+	cached, ok, err := cachedResult(ctx, store, "h1", time.Now())
+	must(t, err)
+	if !ok || cached.Result != "cmVhbA==" || cached.UserId != "u1" {
+		t.Errorf("cached result = %+v, %v, want the worker's result owned by u1", cached, ok)
+	}
+}
+
+// testPNG encodes a blank width x height PNG.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	must(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+	return buf.Bytes()
+}
+
+// testPNGBomb is a PNG header that declares a width x height image with no
+// pixel data behind it, like a decompression bomb that is cut short.
+func testPNGBomb(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 0 // grayscale
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+// uploadRequest builds a multipart task submission. A nil image leaves out
+// the file.
+func uploadRequest(t *testing.T, target string, image []byte) *http.Request {
+	t.Helper()
+	return formRequest(t, target, map[string]string{"filtername": "blur"}, image)
+}
+
+// formRequest posts the fields and, unless it is nil, the image as a
+// multipart form.
+func formRequest(t *testing.T, target string, fields map[string]string, image []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		must(t, form.WriteField(name, value))
+	}
+	if image != nil {
+		part, err := form.CreateFormFile("image", "image.png")
+		must(t, err)
+		part.Write(image)
+	}
+	must(t, form.Close())
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+// fakeQueue records what is published to it, or fails to publish with err.
+type fakeQueue struct {
+	mu        sync.Mutex
+	err       error
+	published []amqp.Publishing
+}
+
+func (q *fakeQueue) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (q *fakeQueue) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func (q *fakeQueue) messages() []amqp.Publishing {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]amqp.Publishing(nil), q.published...)
+}
+
+func TestSubmitTaskRejectsUploads(t *testing.T) {
+	store := NewInMemoryStorage()
+	cfg := Config{
+		UploadLimits:    UploadLimits{MaxBytes: 4 << 10, MaxPixels: 64 * 64},
+		ProcessMaxBytes: 1 << 10,
+	}
+	// Rejected uploads never reach the queue, so no channel is needed.
+	handlers := map[string]http.Handler{
+		"/task":    CreateTaskHandler(nil, store, store, store, store, cfg),
+		"/process": ProcessHandler(nil, store, store, store, store, newTaskWaiter(), cfg),
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		image   []byte
+		status  int
+		code    string
+		message string
+	}{
+		{"missing file", "/task", nil, http.StatusBadRequest, "invalid_request", ""},
+		{"PNG signature only", "/task", []byte("\x89PNG\r\n\x1a\nnot really"), http.StatusBadRequest, "invalid_image", ""},
+		{"text", "/task", []byte("hello, world"), http.StatusUnsupportedMediaType, "unsupported_media_type", "text/plain"},
+		{"PDF", "/task", []byte("%PDF-1.7\n"), http.StatusUnsupportedMediaType, "unsupported_media_type", "application/pdf"},
+		{"too many bytes", "/task", bytes.Repeat([]byte{0}, 4<<10+1), http.StatusRequestEntityTooLarge, "image_too_large", ""},
+		{"too many pixels", "/task", testPNG(t, 65, 64), http.StatusRequestEntityTooLarge, "image_too_many_pixels", "65x64"},
+		{"decompression bomb", "/task", testPNGBomb(100000, 100000), http.StatusRequestEntityTooLarge, "image_too_many_pixels", "100000x100000"},
+		{"too many bytes for /process", "/process", bytes.Repeat([]byte{0}, 1<<10+1), http.StatusRequestEntityTooLarge, "image_too_large", "use POST /task"},
+		{"too many pixels for /process", "/process", testPNGBomb(100000, 100000), http.StatusRequestEntityTooLarge, "image_too_many_pixels", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handlers[tt.target].ServeHTTP(w, uploadRequest(t, tt.target, tt.image))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			var response ErrorResponse
+			must(t, json.NewDecoder(w.Body).Decode(&response))
+			if response.Code != tt.code || !strings.Contains(response.Message, tt.message) {
+				t.Errorf("error %s %q, want %s containing %q", response.Code, response.Message, tt.code, tt.message)
+			}
+			if strings.Contains(response.Message, "POST /task") != strings.Contains(tt.message, "POST /task") {
+				t.Errorf("message %q: unexpected POST /task hint", response.Message)
+			}
+		})
+	}
+
+	tasks, err := store.GetTasks(context.Background())
+	if err != nil || len(tasks) != 0 {
+		t.Errorf("GetTasks = %d tasks, %v, want none for rejected uploads", len(tasks), err)
+	}
+}
+
+func TestResultCacheScope(t *testing.T) {
+	image := testPNG(t, 8, 8)
+	private := Config{}
+	if contentHash(resultCacheScope(private, "u1"), "blur", image) == contentHash(resultCacheScope(private, "u2"), "blur", image) {
+		t.Error("users share cache entries although the cache is not shared")
+	}
+	shared := Config{ResultCacheShared: true}
+	if contentHash(resultCacheScope(shared, "u1"), "blur", image) != contentHash(resultCacheScope(shared, "u2"), "blur", image) {
+		t.Error("users do not share cache entries although the cache is shared")
+	}
+
+	// With a shared cache, u2 gets u1's result without the queue.
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	must(t, store.SetCachedResult(ctx, CachedResult{
+		ContentHash: contentHash(resultCacheScope(shared, "u1"), "blur", image), UserId: "u1", Result: "cmVzdWx0", ExpiresAt: time.Now().Add(time.Hour),
+	}))
+	shared.UploadLimits = UploadLimits{MaxBytes: 1 << 20}
+	shared.ResultCacheTTL = time.Hour
+	r := uploadRequest(t, "/task", image)
+	r = r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u2"}))
+	w := httptest.NewRecorder()
+	CreateTaskHandler(nil, store, store, store, store, shared).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	var response TaskResponse
+	must(t, json.NewDecoder(w.Body).Decode(&response))
+	if task, err := store.GetTask(ctx, response.TaskID); err != nil || task.Status != "ready" || task.Result != "cmVzdWx0" || task.UserId != "u2" {
+		t.Errorf("task = %+v, %v, want u2's task with the cached result", task, err)
+	}
+}
+
+func TestGetResultHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	image := testPNG(t, 16, 16)
+	completedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ready := completeTask(Task{Id: "t1", UserId: "u1", Status: "ready", Result: base64.StdEncoding.EncodeToString(image)}, completedAt)
+	must(t, store.SetTask(ctx, ready))
+	// An ETag is all a revalidation needs; this result would fail to decode.
+	undecoded := ready
+	undecoded.Id, undecoded.Result = "t2", "not base64"
+	must(t, store.SetTask(ctx, undecoded))
+
+	router := chi.NewRouter()
+	router.Get("/result/{taskID}", GetResultHandler(nil, store))
+	get := func(taskID string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/result/"+taskID, nil)
+		r.Header = header
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u1"}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if ready.ResultETag == "" {
+		t.Fatal("completeTask did not set ResultETag")
+	}
+	lastModified := completedAt.UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		taskID string
+		header http.Header
+		status int
+		body   []byte
+	}{
+		{"plain", "t1", http.Header{}, http.StatusOK, image},
+		{"matching ETag", "t1", http.Header{"If-None-Match": {ready.ResultETag}}, http.StatusNotModified, nil},
+		{"matching weak ETag in a list", "t1", http.Header{"If-None-Match": {`"other", W/` + ready.ResultETag}}, http.StatusNotModified, nil},
+		{"any ETag", "t1", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified, nil},
+		{"other ETag", "t1", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, image},
+		{"other ETag and old If-Modified-Since", "t1", http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, http.StatusOK, image},
+		{"not modified since", "t1", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified, nil},
+		{"modified since", "t1", http.Header{"If-Modified-Since": {completedAt.Add(-time.Second).UTC().Format(http.TimeFormat)}}, http.StatusOK, image},
+		{"range", "t1", http.Header{"Range": {"bytes=0-9"}}, http.StatusPartialContent, image[:10]},
+		{"open range", "t1", http.Header{"Range": {"bytes=10-"}}, http.StatusPartialContent, image[10:]},
+		{"suffix range", "t1", http.Header{"Range": {"bytes=-5"}}, http.StatusPartialContent, image[len(image)-5:]},
+		{"range with matching If-Range", "t1", http.Header{"Range": {"bytes=0-9"}, "If-Range": {ready.ResultETag}}, http.StatusPartialContent, image[:10]},
+		{"range with stale If-Range", "t1", http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"other"`}}, http.StatusOK, image},
+		{"unsatisfiable range", "t1", http.Header{"Range": {"bytes=100000-"}}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"revalidation without decoding", "t2", http.Header{"If-None-Match": {ready.ResultETag}}, http.StatusNotModified, nil},
+		{"corrupt result", "t2", http.Header{}, http.StatusInternalServerError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.taskID, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body != nil && !bytes.Equal(w.Body.Bytes(), tt.body) {
+				t.Errorf("body has %d bytes, want %d", w.Body.Len(), len(tt.body))
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with a body of %d bytes", w.Body.Len())
+			}
+			if tt.status < http.StatusBadRequest {
+				if got := w.Header().Get("ETag"); got != ready.ResultETag {
+					t.Errorf("ETag %q, want %q", got, ready.ResultETag)
+				}
+				if got := w.Header().Get("Last-Modified"); got != lastModified {
+					t.Errorf("Last-Modified %q, want %q", got, lastModified)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// healthCheckTimeout bounds each dependency check of /readyz.
+const healthCheckTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	// Status is "ok" or "unavailable".
+	Status string `json:"status" example:"ok"`
+	// Checks maps each dependency to "ok" or "unavailable". Reasons are
+	// only logged, as they may reveal internal addresses.
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// writeHealth runs the checks and answers 200 if all pass, 503 otherwise.
+func writeHealth(w http.ResponseWriter, r *http.Request, checks map[string]func(ctx context.Context) error) {
+	response := HealthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for name, check := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			loggerFromContext(r.Context()).Warn("Health check failed", "check", name, "error", err)
+			response.Status = "unavailable"
+			response.Checks[name] = "unavailable"
+		} else {
+			response.Checks[name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// brokerCheck fails once the RabbitMQ connection or channel is closed. The
+// service does not reconnect, so only a restart recovers from that.
+func brokerCheck(conn *amqp.Connection, ch *amqp.Channel) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		switch {
+		case conn.IsClosed():
+			return errors.New("connection closed")
+		case ch.IsClosed():
+			return errors.New("channel closed")
+		default:
+			return nil
+		}
+	}
+}
+
+// @Summary Liveness check
+// @Description Succeeds while the process is serving requests and still holds its RabbitMQ connection, which it cannot re-establish without a restart. Storage is not checked; see /readyz.
+// @tags health
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Failure 503 {object} HealthResponse "Restart needed"
+// @Router /healthz [get]
+func HealthzHandler(conn *amqp.Connection, ch *amqp.Channel) http.HandlerFunc {
+	checks := map[string]func(ctx context.Context) error{"broker": brokerCheck(conn, ch)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, checks)
+	}
+}
+
+// @Summary Readiness check
+// @Description Checks that storage and RabbitMQ are reachable, so that traffic is only routed to replicas that can serve it.
+// @tags health
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Failure 503 {object} HealthResponse "A dependency is unavailable"
+// @Router /readyz [get]
+func ReadyzHandler(storage Storage, conn *amqp.Connection, ch *amqp.Channel) http.HandlerFunc {
+	checks := map[string]func(ctx context.Context) error{
+		"storage": storage.Ping,
+		"broker":  brokerCheck(conn, ch),
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, checks)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// unreachableStorage fails to ping its database.
+type unreachableStorage struct {
+	Storage
+}
+
+func (unreachableStorage) Ping(ctx context.Context) error {
+	return errors.New("dial tcp 10.0.0.7:5432: connection refused")
+}
+
+func TestHealthHandlers(t *testing.T) {
+	// Zero connections and channels are open as far as IsClosed goes.
+	conn, ch := &amqp.Connection{}, &amqp.Channel{}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		status  int
+		checks  map[string]string
+	}{
+		{"healthz", HealthzHandler(conn, ch), http.StatusOK, map[string]string{"broker": "ok"}},
+		{"readyz", ReadyzHandler(NewInMemoryStorage(), conn, ch), http.StatusOK, map[string]string{"storage": "ok", "broker": "ok"}},
+		{"readyz with storage down", ReadyzHandler(unreachableStorage{NewInMemoryStorage()}, conn, ch), http.StatusServiceUnavailable, map[string]string{"storage": "unavailable", "broker": "ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.7") {
+				t.Errorf("response reveals the failure reason: %s", w.Body)
+			}
+			var response HealthResponse
+			must(t, json.NewDecoder(w.Body).Decode(&response))
+			wantStatus := "ok"
+			if tt.status != http.StatusOK {
+				wantStatus = "unavailable"
+			}
+			if response.Status != wantStatus || len(response.Checks) != len(tt.checks) {
+				t.Fatalf("response %+v, want status %s and checks %v", response, wantStatus, tt.checks)
+			}
+			for name, status := range tt.checks {
+				if response.Checks[name] != status {
+					t.Errorf("check %s = %q, want %q", name, response.Checks[name], status)
+				}
+			}
+		})
+	}
+}
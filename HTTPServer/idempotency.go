@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > 255 {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyFingerprint identifies what the request for task asks for:
+// its input, pipeline and normalized retention.
+func idempotencyFingerprint(task Task) string {
+	return task.ContentHash + "/" + task.ResultTTL.String()
+}
+
+// claimIdempotencyKey claims the request's Idempotency-Key, if any, for
+// task. If the key already belongs to an earlier request it returns that
+// request's task, otherwise an empty Task. release gives the key back and
+// must be called if the request fails later on. On failure
+// claimIdempotencyKey has already written the error response and returns
+// false.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, idempotency IdempotencyStore, tasks TaskStore, window time.Duration, task Task) (original Task, release func(), ok bool) {
+	release = func() {}
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || window <= 0 {
+		return Task{}, release, true
+	}
+	if !validIdempotencyKey(key) {
+		writeError(w, r, http.StatusBadRequest, "invalid_request", "Idempotency-Key must be up to 255 printable ASCII characters")
+		return Task{}, release, false
+	}
+
+	fingerprint := idempotencyFingerprint(task)
+	claimed, err := idempotency.ClaimIdempotencyKey(r.Context(), IdempotencyKey{
+		UserId:      task.UserId,
+		Key:         key,
+		TaskId:      task.Id,
+		Fingerprint: fingerprint,
+		ExpiresAt:   task.CreatedAt.Add(window),
+	}, task.CreatedAt)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return Task{}, release, false
+	}
+	if claimed.TaskId == task.Id {
+		release = func() {
+			if err := idempotency.DeleteIdempotencyKey(context.WithoutCancel(r.Context()), task.UserId, key); err != nil {
+				loggerFromContext(r.Context()).Error("Failed to release idempotency key", "task_id", task.Id, "error", err)
+			}
+		}
+		return Task{}, release, true
+	}
+
+	if claimed.Fingerprint != fingerprint {
+		writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+		return Task{}, release, false
+	}
+	original, err = tasks.GetTask(r.Context(), claimed.TaskId)
+	if errors.Is(err, ErrNotFound) {
+		// The original request has claimed the key but not stored its
+		// task yet.
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusConflict, "request_in_progress", "A request with this Idempotency-Key is still in progress")
+		return Task{}, release, false
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return Task{}, release, false
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	return original, release, true
+}
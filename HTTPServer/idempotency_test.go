@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCreateTaskIdempotency(t *testing.T) {
+	ctx := context.Background()
+	image := testPNG(t, 8, 8)
+	cfg := Config{
+		UploadLimits:      UploadLimits{MaxBytes: 1 << 20},
+		ResultRetention:   ResultRetention{Default: time.Hour, Max: 24 * time.Hour},
+		IdempotencyWindow: time.Hour,
+	}
+
+	newStore := func(t *testing.T) *InMemoryStorage {
+		store := NewInMemoryStorage()
+		mustRegister(t, store, "u1", "alice")
+		return store
+	}
+	submit := func(t *testing.T, handler http.Handler, fields map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := formRequest(t, "/task", fields, image)
+		r.Header.Set(idempotencyKeyHeader, "k1")
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u1"}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	taskID := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+		}
+		var response TaskResponse
+		must(t, json.NewDecoder(w.Body).Decode(&response))
+		return response.TaskID
+	}
+	errorCode := func(t *testing.T, w *httptest.ResponseRecorder, status int) string {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+		}
+		var response ErrorResponse
+		must(t, json.NewDecoder(w.Body).Decode(&response))
+		return response.Code
+	}
+	// released reports whether k1 is free again, claiming it if so.
+	released := func(t *testing.T, store *InMemoryStorage) bool {
+		t.Helper()
+		claimed, err := store.ClaimIdempotencyKey(ctx, IdempotencyKey{UserId: "u1", Key: "k1", TaskId: "probe", ExpiresAt: time.Now().Add(time.Hour)}, time.Now())
+		must(t, err)
+		return claimed.TaskId == "probe"
+	}
+	blur := map[string]string{"filtername": "blur"}
+
+	t.Run("replay", func(t *testing.T) {
+		store := newStore(t)
+		queue := &fakeQueue{}
+		handler := CreateTaskHandler(queue, store, store, store, store, cfg)
+
+		first := taskID(t, submit(t, handler, blur))
+		// The default retention spelled out is the same request.
+		w := submit(t, handler, map[string]string{"filtername": " Blur", "retention": "1h"})
+		if id := taskID(t, w); id != first {
+			t.Errorf("replayed task %s, want %s", id, first)
+		}
+		if w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("replay without Idempotent-Replayed")
+		}
+		if n := len(queue.messages()); n != 1 {
+			t.Errorf("%d tasks queued, want 1", n)
+		}
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		store := newStore(t)
+		handler := CreateTaskHandler(&fakeQueue{}, store, store, store, store, cfg)
+		taskID(t, submit(t, handler, blur))
+
+		for _, fields := range []map[string]string{
+			{"filtername": "sharpen"},
+			{"filtername": "blur", "retention": "2h"},
+		} {
+			if code := errorCode(t, submit(t, handler, fields), http.StatusUnprocessableEntity); code != "idempotency_key_reused" {
+				t.Errorf("%v: error %s, want idempotency_key_reused", fields, code)
+			}
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		store := newStore(t)
+		queue := &fakeQueue{}
+		handler := CreateTaskHandler(queue, store, store, store, store, cfg)
+		// Another request has claimed the key but not stored its task.
+		pending := Task{ContentHash: contentHash("u1", "blur", image), ResultTTL: time.Hour}
+		_, err := store.ClaimIdempotencyKey(ctx, IdempotencyKey{
+			UserId: "u1", Key: "k1", TaskId: "pending", Fingerprint: idempotencyFingerprint(pending), ExpiresAt: time.Now().Add(time.Hour),
+		}, time.Now())
+		must(t, err)
+
+		w := submit(t, handler, blur)
+		if code := errorCode(t, w, http.StatusConflict); code != "request_in_progress" {
+			t.Errorf("error %s, want request_in_progress", code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("no Retry-After")
+		}
+		if n := len(queue.messages()); n != 0 {
+			t.Errorf("%d tasks queued, want none", n)
+		}
+	})
+
+	t.Run("released on quota failure", func(t *testing.T) {
+		store := newStore(t)
+		must(t, store.AddUsage(ctx, "u1", time.Now(), Usage{Tasks: 1}))
+		cfg := cfg
+		cfg.Quotas = Quotas{Daily: Quota{Tasks: 1}}
+		handler := CreateTaskHandler(&fakeQueue{}, store, store, store, store, cfg)
+
+		if code := errorCode(t, submit(t, handler, blur), http.StatusTooManyRequests); code != "quota_exceeded" {
+			t.Errorf("error %s, want quota_exceeded", code)
+		}
+		if !released(t, store) {
+			t.Error("key was kept after the quota was exceeded")
+		}
+	})
+
+	t.Run("released on publish failure", func(t *testing.T) {
+		store := newStore(t)
+		queue := &fakeQueue{err: amqp.ErrClosed}
+		handler := CreateTaskHandler(queue, store, store, store, store, cfg)
+
+		if code := errorCode(t, submit(t, handler, blur), http.StatusServiceUnavailable); code != "queue_unavailable" {
+			t.Errorf("error %s, want queue_unavailable", code)
+		}
+		day, _ := usagePeriods(time.Now())
+		if used, err := store.GetUsage(ctx, "u1", day.start, day.end); err != nil || used.Tasks != 0 {
+			t.Errorf("usage = %+v, %v, want the task given back", used, err)
+		}
+
+		// The key was released, so a retry creates the task anew.
+		queue.err = nil
+		w := submit(t, handler, blur)
+		taskID(t, w)
+		if w.Header().Get("Idempotent-Replayed") != "" {
+			t.Error("retry after a failure was replayed")
+		}
+		if n := len(queue.messages()); n != 1 {
+			t.Errorf("%d tasks queued, want 1", n)
+		}
+	})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// maxPipelineSteps bounds how many filters one image URL may chain.
+const maxPipelineSteps = 8
+
+// imageRetryAfter is how long a derived image that failed, or whose task
+// never completed, is served as is before a request tries again.
+const imageRetryAfter = time.Minute
+
+// derivedImageNamespace scopes the IDs of tasks created for image URLs.
+var derivedImageNamespace = uuid.MustParse("6f1d8a52-3c0e-4b8e-9d57-0a4f2e7c9b31")
+
+// imageURLKeys are the keys of image URLs, all derived from IMAGE_URL_KEY.
+// sign is IMAGE_URL_KEY itself so that backends can sign URLs with nothing
+// but the key; source hides task IDs in source keys and derive makes the
+// IDs of derived image tasks impossible to compute from a URL.
+type imageURLKeys struct {
+	sign   []byte
+	source cipher.Block
+	derive []byte
+}
+
+func newImageURLKeys(secret string) imageURLKeys {
+	// A 16-byte key selects AES-128, which cannot fail.
+	source, _ := aes.NewCipher(hmacSHA256([]byte(secret), "image source key")[:16])
+	return imageURLKeys{
+		sign:   []byte(secret),
+		source: source,
+		derive: hmacSHA256([]byte(secret), "derived image task"),
+	}
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// sourceKey returns the opaque form of a task ID used in image URLs: the
+// task's UUID encrypted as a single AES block, base64url without padding.
+// It returns false for IDs that are not UUIDs.
+func (k imageURLKeys) sourceKey(taskID string) (string, bool) {
+	id, err := uuid.Parse(taskID)
+	if err != nil {
+		return "", false
+	}
+	var block [aes.BlockSize]byte
+	k.source.Encrypt(block[:], id[:])
+	return base64.RawURLEncoding.EncodeToString(block[:]), true
+}
+
+// sourceTaskID reverses sourceKey. Any well-formed key decodes to some ID,
+// so callers must have checked the URL signature first.
+func (k imageURLKeys) sourceTaskID(sourceKey string) (string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(sourceKey)
+	if err != nil || len(data) != aes.BlockSize {
+		return "", false
+	}
+	var id uuid.UUID
+	k.source.Decrypt(id[:], data)
+	return id.String(), true
+}
+
+// signImagePath returns the signature of an image URL path of the form
+// /{pipeline}/{sourceKey}: HMAC-SHA256 with key, base64url without padding.
+func signImagePath(key []byte, path string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(key, path))
+}
+
+func validImageSignature(key []byte, signature string, path string) bool {
+	return hmac.Equal([]byte(signature), []byte(signImagePath(key, path)))
+}
+
+// parsePipeline checks a comma-separated list of filter names such as
+// "blur,blur". Whether the filters exist is up to the worker.
+func parsePipeline(pipeline string) error {
+	steps := strings.Split(pipeline, ",")
+	if len(steps) > maxPipelineSteps {
+		return fmt.Errorf("pipeline must not have more than %d steps", maxPipelineSteps)
+	}
+	for _, step := range steps {
+		if step == "" {
+			return fmt.Errorf("pipeline has an empty step")
+		}
+		for _, c := range step {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+				return fmt.Errorf("invalid filter name %q", step)
+			}
+		}
+	}
+	return nil
+}
+
+// derivedImageTaskID is the ID of the task holding the result of pipeline
+// applied to the source task. Being derived from both, it doubles as the
+// cache key: every replica and storage backend finds the same task. The
+// HMAC keeps it from being computed, and the task read, without the key.
+func (k imageURLKeys) derivedImageTaskID(sourceID string, pipeline string) string {
+	return uuid.NewSHA1(derivedImageNamespace, hmacSHA256(k.derive, pipeline+"/"+sourceID)).String()
+}
+
+// needsProcessing reports whether a derived image task has to be
+// (re)submitted to the worker.
+func needsProcessing(task Task, now time.Time) bool {
+	switch {
+	case task.ResultExpired(now):
+		return true
+	case task.Status == "failed" || task.Status == "in_progress":
+		return now.Sub(task.CreatedAt) > imageRetryAfter
+	default:
+		return false
+	}
+}
+
+// @Summary Get a derived image
+// @Description Applies a pipeline of filters to the result of a ready task and returns the image, processing it on first request and serving it from storage afterwards. URLs are signed rather than authenticated: signature is the base64url (unpadded) HMAC-SHA256 of "/{pipeline}/{sourceKey}" under IMAGE_URL_KEY.
+// @tags images
+// @Produce image/png
+// @Produce json
+// @Param signature path string true "URL signature"
+// @Param pipeline path string true "Comma-separated filters, e.g. blur"
+// @Param sourceKey path string true "image_key of the task whose result is the source image, from GET /status"
+// @Success 200 {file} file "Derived image in PNG format"
+// @Success 304 "Not modified"
+// @Failure 400 {object} ErrorResponse "Invalid pipeline"
+// @Failure 403 {object} ErrorResponse "Invalid signature"
+// @Failure 404 {object} ErrorResponse "Source image not found"
+// @Failure 422 {object} ErrorResponse "Processing failed"
+// @Failure 429 {object} ErrorResponse "The source owner's task rate limit or quota is used up"
+// @Failure 503 {object} ErrorResponse "Not processed in time, storage or queue unavailable"
+// @Router /img/{signature}/{pipeline}/{sourceKey} [get]
+func ImageHandler(ch taskQueue, store Storage, waiter *taskWaiter, limiter *rateLimiter, cfg Config) http.HandlerFunc {
+	keys := newImageURLKeys(cfg.ImageURLKey)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Errors are not cached: the image may well be there next time.
+		w.Header().Set("Cache-Control", "no-store")
+
+		signature := chi.URLParam(r, "signature")
+		pipeline := chi.URLParam(r, "pipeline")
+		sourceKey := chi.URLParam(r, "sourceKey")
+		if !validImageSignature(keys.sign, signature, "/"+pipeline+"/"+sourceKey) {
+			writeError(w, r, http.StatusForbidden, "invalid_signature", "Invalid signature")
+			return
+		}
+		if err := parsePipeline(pipeline); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_pipeline", err.Error())
+			return
+		}
+
+		// A derived image lives no longer than its source: once the
+		// source is gone or expired, so are the URLs built on it.
+		now := time.Now()
+		source, ok := imageSource(w, r, store, keys, sourceKey, now)
+		if !ok {
+			return
+		}
+		taskID := keys.derivedImageTaskID(source.Id, pipeline)
+		etag := `"` + taskID + `"`
+		task, err := store.GetTask(r.Context(), taskID)
+		if errors.Is(err, ErrNotFound) || (err == nil && needsProcessing(task, now)) {
+			if !submitDerivedImage(w, r, ch, store, limiter, cfg, taskID, source, pipeline, now) {
+				return
+			}
+			err = nil
+		} else if err == nil && task.Status == "ready" && r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("Cache-Control", imageCacheControl(cfg.ImageCacheMaxAge, task, now))
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.ProcessTimeout)
+		defer cancel()
+		task, err = waiter.Wait(ctx, store, taskID)
+		switch {
+		case r.Context().Err() != nil:
+			// The client is gone; the task carries on in the background.
+		case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrNotFound):
+			// A task that is not there yet was claimed by a concurrent
+			// request that has not stored it so far.
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "not_ready", "Image is still being processed")
+		case err != nil:
+			writeStorageError(w, r, err)
+		default:
+			if now := time.Now(); task.Status == "ready" && !task.ResultExpired(now) {
+				w.Header().Set("Cache-Control", imageCacheControl(cfg.ImageCacheMaxAge, task, now))
+				w.Header().Set("ETag", etag)
+			}
+			writeResult(w, r, task)
+		}
+	}
+}
+
+// imageCacheControl is the Cache-Control of a derived image: cacheable for
+// maxAge, but no longer than the image is retained. Only images kept forever
+// are immutable.
+func imageCacheControl(maxAge time.Duration, task Task, now time.Time) string {
+	if task.ExpiresAt.IsZero() {
+		return fmt.Sprintf("public, max-age=%d, immutable", int(maxAge.Seconds()))
+	}
+	maxAge = max(min(maxAge, task.ExpiresAt.Sub(now)), 0)
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+// imageSource returns the ready task that sourceKey refers to. On failure
+// it has already written the error response and returns false.
+func imageSource(w http.ResponseWriter, r *http.Request, tasks TaskStore, keys imageURLKeys, sourceKey string, now time.Time) (Task, bool) {
+	sourceID, ok := keys.sourceTaskID(sourceKey)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "source_not_found", "Source image not found")
+		return Task{}, false
+	}
+	source, err := tasks.GetTask(r.Context(), sourceID)
+	if errors.Is(err, ErrNotFound) || (err == nil && (source.Status != "ready" || source.ResultExpired(now))) {
+		writeError(w, r, http.StatusNotFound, "source_not_found", "Source image not found")
+		return Task{}, false
+	}
+	if err != nil {
+		writeStorageError(w, r, err)
+		return Task{}, false
+	}
+	return source, true
+}
+
+// derivedImageTTL is the retention of a derived image of source: the
+// default, but no longer than the source's result is kept.
+func derivedImageTTL(source Task, retention ResultRetention, now time.Time) time.Duration {
+	if source.ExpiresAt.IsZero() {
+		return retention.Default
+	}
+	left := source.ExpiresAt.Sub(now)
+	if retention.Default > 0 && retention.Default < left {
+		return retention.Default
+	}
+	return left
+}
+
+// derivedImageClaimPrefix marks the idempotency keys that claim derived
+// image tasks; see claimDerivedImage.
+const derivedImageClaimPrefix = "img:"
+
+// claimDerivedImage claims submitting the derived image task taskID, so
+// that of concurrent requests for a new image only one queues it. The claim
+// is an idempotency key of the owner keyed on the task ID, and expires
+// after imageRetryAfter like the submission it guards. won is false if
+// another request holds the claim; release gives up a claim that was won.
+func claimDerivedImage(ctx context.Context, claims IdempotencyStore, taskID string, owner string, now time.Time) (release func(), won bool, err error) {
+	key := derivedImageClaimPrefix + taskID
+	token := uuid.NewString()
+	claimed, err := claims.ClaimIdempotencyKey(ctx, IdempotencyKey{
+		UserId:      owner,
+		Key:         key,
+		TaskId:      taskID,
+		Fingerprint: token,
+		ExpiresAt:   now.Add(imageRetryAfter),
+	}, now)
+	if err != nil || claimed.Fingerprint != token {
+		return nil, false, err
+	}
+	release = func() {
+		if err := claims.DeleteIdempotencyKey(context.WithoutCancel(ctx), owner, key); err != nil {
+			loggerFromContext(ctx).Error("Failed to release derived image claim", "task_id", taskID, "error", err)
+		}
+	}
+	return release, true, nil
+}
+
+// submitDerivedImage queues the pipeline for the result of source under
+// taskID, unless a concurrent request has claimed doing so. The work is
+// charged to the source's owner: it draws from their task rate limit and
+// counts against their quotas. The derived task belongs to the owner, is
+// deleted with them and expires no later than the source. On failure it
+// has already written the error response and returns false.
+func submitDerivedImage(w http.ResponseWriter, r *http.Request, ch taskQueue, store Storage, limiter *rateLimiter, cfg Config, taskID string, source Task, pipeline string, now time.Time) bool {
+	releaseClaim, won, err := claimDerivedImage(r.Context(), store, taskID, source.UserId, now)
+	if err != nil {
+		writeStorageError(w, r, err)
+		return false
+	}
+	if !won {
+		return true
+	}
+
+	if allowed, wait := limiter.Allow("user:"+source.UserId, now); !allowed {
+		releaseClaim()
+		setRetryAfter(w, wait)
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many tasks")
+		return false
+	}
+	owner, err := store.GetUserById(r.Context(), source.UserId)
+	if err != nil {
+		releaseClaim()
+		writeStorageError(w, r, err)
+		return false
+	}
+	input, err := decodeResult(source.Result)
+	if err != nil {
+		releaseClaim()
+		loggerFromContext(r.Context()).Error("Corrupt result", "task_id", source.Id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "corrupt_result", "Failed to decode the source image")
+		return false
+	}
+	var quotaErr *quotaError
+	releaseUsage, err := reserveQuota(r.Context(), Identity{UserId: owner.id, Role: owner.role}, store, cfg.Quotas, int64(len(input)), now)
+	if errors.As(err, &quotaErr) {
+		releaseClaim()
+		setRetryAfter(w, quotaErr.reset.Sub(now))
+		writeError(w, r, http.StatusTooManyRequests, "quota_exceeded", quotaErr.Error())
+		return false
+	}
+	if err != nil {
+		releaseClaim()
+		writeStorageError(w, r, err)
+		return false
+	}
+
+	task := Task{
+		Id:         taskID,
+		UserId:     source.UserId,
+		FilterName: pipeline,
+		CreatedAt:  now,
+		Status:     "in_progress",
+		ResultTTL:  derivedImageTTL(source, cfg.ResultRetention, now),
+		SourceId:   source.Id,
+	}
+	if err := store.SetTask(r.Context(), task); err != nil {
+		releaseUsage()
+		releaseClaim()
+		writeStorageError(w, r, err)
+		return false
+	}
+	err = publishTask(r.Context(), ch, ImageFilterMessage{
+		TaskId:      task.Id,
+		ImageBase64: source.Result,
+		FilterName:  pipeline,
+	})
+	if err != nil {
+		loggerFromContext(r.Context()).Error("Failed to publish task", "task_id", task.Id, "error", err)
+		releaseUsage()
+		// The task stays in progress and the claim in place; the task is
+		// resubmitted once both have expired, after imageRetryAfter.
+		w.Header().Set("Retry-After", strconv.Itoa(int(imageRetryAfter.Seconds())))
+		writeError(w, r, http.StatusServiceUnavailable, "queue_unavailable", "Queue unavailable")
+		return false
+	}
+	tasksCreatedTotal.WithLabelValues(filterLabel(pipeline), "false").Inc()
+	return true
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const testImageURLKey = "image-url-secret"
+
+func TestImageHandlerSignature(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	now := time.Now()
+	keys := newImageURLKeys(testImageURLKey)
+	source := Task{Id: uuid.NewString(), UserId: "u1", CreatedAt: now, Status: "ready", Result: base64.StdEncoding.EncodeToString([]byte("source"))}
+	must(t, store.SetTask(ctx, source))
+	// The derived image is already there, so no request reaches the queue.
+	must(t, store.SetTask(ctx, Task{
+		Id: keys.derivedImageTaskID(source.Id, "blur"), UserId: "u1", CreatedAt: now, Status: "ready",
+		Result: base64.StdEncoding.EncodeToString([]byte("blurred")), CompletedAt: now, SourceId: source.Id,
+	}))
+	sourceKey, ok := keys.sourceKey(source.Id)
+	if !ok {
+		t.Fatal("sourceKey failed for a UUID")
+	}
+
+	router := chi.NewRouter()
+	cfg := Config{ImageURLKey: testImageURLKey, ProcessTimeout: time.Second}
+	router.Get("/img/{signature}/{pipeline}/{sourceKey}", ImageHandler(nil, store, newTaskWaiter(), nil, cfg))
+
+	valid := signImagePath([]byte(testImageURLKey), "/blur/"+sourceKey)
+	otherSourceKey, _ := keys.sourceKey(uuid.NewString())
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"valid signature", "/img/" + valid + "/blur/" + sourceKey, http.StatusOK},
+		{"pipeline changed", "/img/" + valid + "/blur,blur/" + sourceKey, http.StatusForbidden},
+		{"source changed", "/img/" + valid + "/blur/" + otherSourceKey, http.StatusForbidden},
+		{"raw task ID as source", "/img/" + signImagePath([]byte(testImageURLKey), "/blur/"+source.Id) + "/blur/" + source.Id, http.StatusNotFound},
+		{"other key", "/img/" + signImagePath([]byte("other"), "/blur/"+sourceKey) + "/blur/" + sourceKey, http.StatusForbidden},
+		{"padded signature", "/img/" + valid + "=/blur/" + sourceKey, http.StatusForbidden},
+		{"standard base64", "/img/" + url.PathEscape(base64.StdEncoding.EncodeToString(hmacSHA256([]byte(testImageURLKey), "/blur/"+sourceKey))) + "/blur/" + sourceKey, http.StatusForbidden},
+		{"truncated signature", "/img/" + valid[:len(valid)-1] + "/blur/" + sourceKey, http.StatusForbidden},
+		{"garbage signature", "/img/x/blur/" + sourceKey, http.StatusForbidden},
+		{"signed unknown source", "/img/" + signImagePath([]byte(testImageURLKey), "/blur/"+otherSourceKey) + "/blur/" + otherSourceKey, http.StatusNotFound},
+		{"signed invalid pipeline", "/img/" + signImagePath([]byte(testImageURLKey), "/Blur/"+sourceKey) + "/Blur/" + sourceKey, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.code {
+				t.Errorf("GET %s: status %d, want %d: %s", tt.path, w.Code, tt.code, w.Body)
+			}
+			if tt.code == http.StatusOK && w.Body.String() != "blurred" {
+				t.Errorf("GET %s: body %q, want the derived image", tt.path, w.Body)
+			}
+			if tt.code != http.StatusOK && w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("GET %s: error cached with %q", tt.path, w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestImageURLKeys(t *testing.T) {
+	keys := newImageURLKeys(testImageURLKey)
+	id := uuid.NewString()
+
+	key, ok := keys.sourceKey(id)
+	if !ok {
+		t.Fatal("sourceKey failed for a UUID")
+	}
+	if strings.Contains(key, id) || strings.Contains(key, strings.ReplaceAll(id, "-", "")) {
+		t.Errorf("sourceKey %q exposes the task ID", key)
+	}
+	if got, ok := keys.sourceTaskID(key); !ok || got != id {
+		t.Errorf("sourceTaskID(sourceKey(%s)) = %q, %v", id, got, ok)
+	}
+	if other, _ := newImageURLKeys("other").sourceKey(id); other == key {
+		t.Error("sourceKey does not depend on the key")
+	}
+	if _, ok := keys.sourceKey("not-a-uuid"); ok {
+		t.Error("sourceKey accepted an ID that is not a UUID")
+	}
+	for _, bad := range []string{"", "%%%", key[:len(key)-2], key + "AA"} {
+		if _, ok := keys.sourceTaskID(bad); ok {
+			t.Errorf("sourceTaskID accepted %q", bad)
+		}
+	}
+
+	derived := keys.derivedImageTaskID(id, "blur")
+	if derived == newImageURLKeys("other").derivedImageTaskID(id, "blur") {
+		t.Error("derivedImageTaskID does not depend on the key")
+	}
+	if derived == keys.derivedImageTaskID(id, "blur,blur") {
+		t.Error("derivedImageTaskID does not depend on the pipeline")
+	}
+}
+
+func TestImageHandlerCacheControl(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	now := time.Now()
+	keys := newImageURLKeys(testImageURLKey)
+	source := Task{Id: uuid.NewString(), UserId: "u1", CreatedAt: now, Status: "ready", Result: base64.StdEncoding.EncodeToString([]byte("source"))}
+	must(t, store.SetTask(ctx, source))
+	sourceKey, _ := keys.sourceKey(source.Id)
+	derived := func(pipeline string, expiresAt time.Time) string {
+		id := keys.derivedImageTaskID(source.Id, pipeline)
+		must(t, store.SetTask(ctx, Task{
+			Id: id, UserId: "u1", CreatedAt: now, Status: "ready", Result: base64.StdEncoding.EncodeToString([]byte("image")),
+			CompletedAt: now, ExpiresAt: expiresAt, SourceId: source.Id,
+		}))
+		return `"` + id + `"`
+	}
+
+	router := chi.NewRouter()
+	cfg := Config{ImageURLKey: testImageURLKey, ImageCacheMaxAge: time.Hour, ProcessTimeout: time.Second}
+	router.Get("/img/{signature}/{pipeline}/{sourceKey}", ImageHandler(nil, store, newTaskWaiter(), nil, cfg))
+
+	tests := []struct {
+		name     string
+		pipeline string
+		etag     string
+		want     string
+	}{
+		{"kept forever", "blur", derived("blur", time.Time{}), "public, max-age=3600, immutable"},
+		{"kept longer than max-age", "blur,blur", derived("blur,blur", now.Add(2*time.Hour)), "public, max-age=3600"},
+		{"expiring before max-age", "blur,blur,blur", derived("blur,blur,blur", now.Add(10*time.Minute)), "public, max-age=599"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/" + tt.pipeline + "/" + sourceKey
+			for _, ifNoneMatch := range []string{"", tt.etag} {
+				r := httptest.NewRequest(http.MethodGet, "/img/"+signImagePath([]byte(testImageURLKey), path)+path, nil)
+				if ifNoneMatch != "" {
+					r.Header.Set("If-None-Match", ifNoneMatch)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				if w.Code != http.StatusOK && w.Code != http.StatusNotModified {
+					t.Fatalf("If-None-Match %q: status %d: %s", ifNoneMatch, w.Code, w.Body)
+				}
+				// max-age is rounded down to whole seconds of what is left.
+				got := w.Header().Get("Cache-Control")
+				if got != tt.want && got != strings.Replace(tt.want, "599", "600", 1) {
+					t.Errorf("If-None-Match %q: Cache-Control %q, want %q", ifNoneMatch, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimDerivedImage(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	now := time.Now()
+
+	var won atomic.Int64
+	var releases []func()
+	var mu sync.Mutex
+	parallel(20, func(int) {
+		release, ok, err := claimDerivedImage(ctx, store, "t1", "u1", now)
+		if err != nil {
+			t.Error(err)
+		}
+		if ok {
+			won.Add(1)
+			mu.Lock()
+			releases = append(releases, release)
+			mu.Unlock()
+		}
+	})
+	if won.Load() != 1 {
+		t.Fatalf("%d of 20 concurrent claims won, want 1", won.Load())
+	}
+	if _, ok, _ := claimDerivedImage(ctx, store, "t2", "u1", now); !ok {
+		t.Error("claim of another task lost")
+	}
+
+	releases[0]()
+	if _, ok, _ := claimDerivedImage(ctx, store, "t1", "u1", now); !ok {
+		t.Error("claim lost after the winner released it")
+	}
+	if _, ok, _ := claimDerivedImage(ctx, store, "t1", "u1", now.Add(imageRetryAfter)); !ok {
+		t.Error("claim lost after the previous one expired")
+	}
+}
+
+// TestImageHandlerCharges checks that new derived images are charged to the
+// source's owner, and that requests that may not submit one leave the claim
+// to others. None of them reaches the queue.
+func TestImageHandlerCharges(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	keys := newImageURLKeys(testImageURLKey)
+	sourceID := uuid.NewString()
+	taskID := keys.derivedImageTaskID(sourceID, "blur")
+	sourceKey, _ := keys.sourceKey(sourceID)
+	path := "/blur/" + sourceKey
+	target := "/img/" + signImagePath([]byte(testImageURLKey), path) + path
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, store Storage, limiter *rateLimiter)
+		status  int
+		code    string
+		claimed bool // whether the claim is still held afterwards
+	}{
+		{
+			name: "claimed by another request",
+			setup: func(t *testing.T, store Storage, limiter *rateLimiter) {
+				_, _, err := claimDerivedImage(ctx, store, taskID, "u1", now)
+				must(t, err)
+			},
+			status: http.StatusServiceUnavailable, code: "not_ready", claimed: true,
+		},
+		{
+			name: "owner rate limited",
+			setup: func(t *testing.T, store Storage, limiter *rateLimiter) {
+				limiter.Allow("user:u1", now)
+			},
+			status: http.StatusTooManyRequests, code: "rate_limited",
+		},
+		{
+			name: "owner over quota",
+			setup: func(t *testing.T, store Storage, limiter *rateLimiter) {
+				must(t, store.AddUsage(ctx, "u1", now, Usage{Tasks: 1}))
+			},
+			status: http.StatusTooManyRequests, code: "quota_exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryStorage()
+			mustRegister(t, store, "u1", "alice")
+			must(t, store.SetTask(ctx, Task{Id: sourceID, UserId: "u1", CreatedAt: now, Status: "ready", Result: base64.StdEncoding.EncodeToString([]byte("source"))}))
+			limiter := newRateLimiter(60, time.Minute, 1)
+			tt.setup(t, store, limiter)
+
+			cfg := Config{ImageURLKey: testImageURLKey, ProcessTimeout: 10 * time.Millisecond, Quotas: Quotas{Daily: Quota{Tasks: 1}}}
+			router := chi.NewRouter()
+			router.Get("/img/{signature}/{pipeline}/{sourceKey}", ImageHandler(nil, store, newTaskWaiter(), limiter, cfg))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+			var response ErrorResponse
+			must(t, json.NewDecoder(w.Body).Decode(&response))
+			if w.Code != tt.status || response.Code != tt.code {
+				t.Errorf("status %d %s, want %d %s", w.Code, response.Code, tt.status, tt.code)
+			}
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After")
+			}
+			_, err := store.GetTask(ctx, taskID)
+			mustBeMissing(t, err, "derived task")
+			day, _ := usagePeriods(now)
+			if used, err := store.GetUsage(ctx, "u1", day.start, day.end); err != nil || used.Tasks > 1 || used.InputBytes != 0 {
+				t.Errorf("usage = %+v, %v, want nothing charged", used, err)
+			}
+			if _, won, _ := claimDerivedImage(ctx, store, taskID, "u1", now); won == tt.claimed {
+				t.Errorf("claim won afterwards = %v, want %v", won, !tt.claimed)
+			}
+		})
+	}
+}
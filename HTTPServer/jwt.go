@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+type jwtKey struct {
+	id     string
+	sign   any
+	verify any
+}
+
+type accessClaims struct {
+	SessionId string `json:"sid"`
+	Role      string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// jwtAuthenticator hands out short-lived signed access tokens that are
+// verified without touching storage, plus refresh tokens that are persisted
+// so they can be rotated, listed and revoked. The refresh token ID doubles
+// as the session ID ("sid" claim) of every access token minted from it.
+type jwtAuthenticator struct {
+	users      UserStore
+	sessions   SessionStore
+	method     jwt.SigningMethod
+	keys       map[string]jwtKey
+	signingKey jwtKey
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// newJWTAuthenticator builds the authenticator from JWT_KEYS, a comma
+// separated list of kid:base64 pairs. HS256 keys are raw secrets, EdDSA keys
+// are Ed25519 seeds or private keys. Every listed key is accepted when
+// verifying, which allows rotating the signing key without logging users out.
+func newJWTAuthenticator(store Storage, cfg Config) (*jwtAuthenticator, error) {
+	a := &jwtAuthenticator{
+		users:      store,
+		sessions:   store,
+		keys:       make(map[string]jwtKey),
+		issuer:     cfg.JWTIssuer,
+		accessTTL:  cfg.AccessTokenTTL,
+		refreshTTL: cfg.RefreshTokenTTL,
+	}
+
+	switch cfg.JWTAlgorithm {
+	case "HS256":
+		a.method = jwt.SigningMethodHS256
+	case "EdDSA":
+		a.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.JWTAlgorithm)
+	}
+
+	var firstKid string
+	for _, entry := range strings.Split(cfg.JWTKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, encoded, found := strings.Cut(entry, ":")
+		if !found || kid == "" {
+			return nil, fmt.Errorf("JWT key %q must have the form kid:base64", entry)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q: %w", kid, err)
+		}
+		key, err := newJWTKey(a.method, kid, raw)
+		if err != nil {
+			return nil, err
+		}
+		a.keys[kid] = key
+		if firstKid == "" {
+			firstKid = kid
+		}
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.New("JWT_KEYS must contain at least one key")
+	}
+
+	signingKid := cfg.JWTSigningKeyID
+	if signingKid == "" {
+		signingKid = firstKid
+	}
+	key, ok := a.keys[signingKid]
+	if !ok {
+		return nil, fmt.Errorf("JWT signing key %q is not listed in JWT_KEYS", signingKid)
+	}
+	a.signingKey = key
+	return a, nil
+}
+
+func newJWTKey(method jwt.SigningMethod, kid string, raw []byte) (jwtKey, error) {
+	switch method {
+	case jwt.SigningMethodHS256:
+		if len(raw) < 32 {
+			return jwtKey{}, fmt.Errorf("JWT key %q: HS256 secrets must be at least 32 bytes", kid)
+		}
+		return jwtKey{id: kid, sign: raw, verify: raw}, nil
+	default:
+		var private ed25519.PrivateKey
+		switch len(raw) {
+		case ed25519.SeedSize:
+			private = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			private = ed25519.PrivateKey(raw)
+		default:
+			return jwtKey{}, fmt.Errorf("JWT key %q: EdDSA keys must be a 32 byte seed or 64 byte private key", kid)
+		}
+		return jwtKey{id: kid, sign: private, verify: private.Public()}, nil
+	}
+}
+
+// Issue starts a new session. Access tokens carry the user's role and are
+// not checked against storage, so disabling a user or changing their role
+// takes effect once their current access token expires.
+func (a *jwtAuthenticator) Issue(user User, r *http.Request) (TokenResponse, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	now := time.Now()
+	refresh := RefreshToken{
+		Id:         uuid.New().String(),
+		UserId:     user.id,
+		Hash:       hashToken(secret),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(a.refreshTTL),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: clientIP(r),
+	}
+	if err := a.sessions.SetRefreshToken(r.Context(), refresh); err != nil {
+		return TokenResponse{}, err
+	}
+
+	return a.tokenResponse(refresh, user.role, secret, now)
+}
+
+// Refresh exchanges a refresh token for a new access token and rotates the
+// refresh token. Presenting an already rotated token revokes the whole
+// session, since it means the token has leaked.
+func (a *jwtAuthenticator) Refresh(ctx context.Context, token string) (TokenResponse, error) {
+	id, secret, found := strings.Cut(token, ".")
+	if !found {
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	now := time.Now()
+	refresh, err := a.sessions.GetRefreshToken(ctx, id)
+	if errors.Is(err, ErrNotFound) || err == nil && refresh.Expired(now) {
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	user, err := a.users.GetUserById(ctx, refresh.UserId)
+	if errors.Is(err, ErrNotFound) || err == nil && user.disabled {
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	newSecret, err := randomToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	err = a.sessions.RotateRefreshToken(ctx, id, hashToken(secret), hashToken(newSecret), now)
+	if errors.Is(err, ErrNotFound) {
+		loggerFromContext(ctx).Warn("Refresh token reuse detected, revoking the session", "session_id", id)
+		if err := a.sessions.DeleteRefreshToken(ctx, id); err != nil {
+			return TokenResponse{}, err
+		}
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	refresh.LastUsedAt = now
+	return a.tokenResponse(refresh, user.role, newSecret, now)
+}
+
+func (a *jwtAuthenticator) tokenResponse(refresh RefreshToken, role string, secret string, now time.Time) (TokenResponse, error) {
+	expiresAt := now.Add(a.accessTTL)
+	token := jwt.NewWithClaims(a.method, accessClaims{
+		SessionId: refresh.Id,
+		Role:      role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    a.issuer,
+			Subject:   refresh.UserId,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["kid"] = a.signingKey.id
+
+	signed, err := token.SignedString(a.signingKey.sign)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken:  signed,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(a.accessTTL / time.Second),
+		ExpiresAt:    expiresAt,
+		RefreshToken: refresh.Id + "." + secret,
+	}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := a.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return key.verify, nil
+	},
+		jwt.WithValidMethods([]string{a.method.Alg()}),
+		jwt.WithIssuer(a.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Subject == "" {
+		return Identity{}, errInvalidToken
+	}
+	return Identity{UserId: claims.Subject, Role: claims.Role, SessionId: claims.SessionId}, nil
+}
+
+// Revoke deletes the refresh token behind the identity. Access tokens that
+// were already issued stay valid until they expire.
+func (a *jwtAuthenticator) Revoke(ctx context.Context, identity Identity) error {
+	return a.sessions.DeleteRefreshToken(ctx, identity.SessionId)
+}
+
+func (a *jwtAuthenticator) RevokeOthers(ctx context.Context, identity Identity) error {
+	return a.sessions.DeleteUserRefreshTokens(ctx, identity.UserId, identity.SessionId)
+}
+
+func (a *jwtAuthenticator) Sessions(ctx context.Context, identity Identity) ([]SessionResponse, error) {
+	tokens, err := a.sessions.GetUserRefreshTokens(ctx, identity.UserId)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]SessionResponse, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, SessionResponse{
+			Current:    token.Id == identity.SessionId,
+			CreatedAt:  token.CreatedAt,
+			LastSeenAt: token.LastUsedAt,
+			ExpiresAt:  token.ExpiresAt,
+			UserAgent:  token.UserAgent,
+			RemoteAddr: token.RemoteAddr,
+		})
+	}
+	return response, nil
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// @Summary Refresh access token
+// @Description Only available when AUTH_MODE=jwt. Exchanges a refresh token for a new access token; the refresh token is rotated and the old one stops working.
+// @tags auth
+// @Accept json
+// @Produce json
+// @Param token body RefreshTokenRequest true "Refresh token"
+// @Success 200 {object} TokenResponse
+// @Failure 401 {object} ErrorResponse "Invalid refresh token"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /token/refresh [post]
+func RefreshTokenHandler(auth *jwtAuthenticator, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data RefreshTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		response, err := auth.Refresh(r.Context(), data.RefreshToken)
+		if errors.Is(err, errInvalidRefreshToken) {
+			writeError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid refresh token")
+			return
+		}
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeTokenResponse(w, cfg, response)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testJWTSecret returns a base64 HS256 secret that differs per name.
+func testJWTSecret(name string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(name, 32)[:32]))
+}
+
+func newTestJWTAuthenticator(t *testing.T, store Storage, algorithm string, keys string, signingKid string) *jwtAuthenticator {
+	t.Helper()
+	auth, err := newJWTAuthenticator(store, Config{
+		JWTAlgorithm:    algorithm,
+		JWTKeys:         keys,
+		JWTSigningKeyID: signingKid,
+		JWTIssuer:       "test",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func issueTestToken(t *testing.T, auth *jwtAuthenticator, user User) TokenResponse {
+	t.Helper()
+	response, err := auth.Issue(user, httptest.NewRequest("POST", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	store := NewInMemoryStorage()
+	user := mustRegister(t, store, "u1", "alice")
+	old := "old:" + testJWTSecret("a")
+	next := "new:" + testJWTSecret("b")
+
+	before := newTestJWTAuthenticator(t, store, "HS256", old, "")
+	oldToken := issueTestToken(t, before, user).AccessToken
+
+	// The new key signs, the old one is still accepted.
+	during := newTestJWTAuthenticator(t, store, "HS256", next+","+old, "new")
+	newToken := issueTestToken(t, during, user).AccessToken
+	// Once the old key is dropped, its tokens stop working.
+	after := newTestJWTAuthenticator(t, store, "HS256", next, "")
+
+	tests := []struct {
+		name  string
+		auth  *jwtAuthenticator
+		token string
+		valid bool
+	}{
+		{"old token before rotation", before, oldToken, true},
+		{"old token during rotation", during, oldToken, true},
+		{"new token during rotation", during, newToken, true},
+		{"new token before rotation", before, newToken, false},
+		{"old token after rotation", after, oldToken, false},
+		{"new token after rotation", after, newToken, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := tt.auth.Authenticate(context.Background(), tt.token)
+			if tt.valid && (err != nil || identity.UserId != "u1") {
+				t.Errorf("Authenticate = %+v, %v, want user u1", identity, err)
+			}
+			if !tt.valid && !errors.Is(err, errInvalidToken) {
+				t.Errorf("Authenticate error = %v, want errInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestJWTRejectsForeignTokens(t *testing.T) {
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	secret, _ := base64.StdEncoding.DecodeString(testJWTSecret("a"))
+	auth := newTestJWTAuthenticator(t, store, "HS256", "k1:"+testJWTSecret("a"), "")
+	_, edKey, _ := ed25519.GenerateKey(nil)
+
+	now := time.Now()
+	claims := func(mutate func(*accessClaims)) accessClaims {
+		c := accessClaims{
+			SessionId: "s1",
+			Role:      RoleUser,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "test",
+				Subject:   "u1",
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}
+		if mutate != nil {
+			mutate(&c)
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, kid string, c accessClaims, key any) string {
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"well-formed token", sign(jwt.SigningMethodHS256, "k1", claims(nil), secret), true},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "k2", claims(nil), secret), false},
+		{"missing kid", sign(jwt.SigningMethodHS256, "", claims(nil), secret), false},
+		{"other secret", sign(jwt.SigningMethodHS256, "k1", claims(nil), []byte(strings.Repeat("x", 32))), false},
+		{"HS384 with the same secret", sign(jwt.SigningMethodHS384, "k1", claims(nil), secret), false},
+		{"EdDSA", sign(jwt.SigningMethodEdDSA, "k1", claims(nil), edKey), false},
+		{"alg none", sign(jwt.SigningMethodNone, "k1", claims(nil), jwt.UnsafeAllowNoneSignatureType), false},
+		{"other issuer", sign(jwt.SigningMethodHS256, "k1", claims(func(c *accessClaims) { c.Issuer = "other" }), secret), false},
+		{"expired", sign(jwt.SigningMethodHS256, "k1", claims(func(c *accessClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Second)) }), secret), false},
+		{"no expiry", sign(jwt.SigningMethodHS256, "k1", claims(func(c *accessClaims) { c.ExpiresAt = nil }), secret), false},
+		{"no subject", sign(jwt.SigningMethodHS256, "k1", claims(func(c *accessClaims) { c.Subject = "" }), secret), false},
+		{"garbage", "not.a.token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.Authenticate(context.Background(), tt.token)
+			if tt.valid && err != nil {
+				t.Errorf("Authenticate error = %v, want success", err)
+			}
+			if !tt.valid && !errors.Is(err, errInvalidToken) {
+				t.Errorf("Authenticate error = %v, want errInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestJWTEdDSA(t *testing.T) {
+	store := NewInMemoryStorage()
+	user := mustRegister(t, store, "u1", "alice")
+	seed := make([]byte, ed25519.SeedSize)
+	auth := newTestJWTAuthenticator(t, store, "EdDSA", "ed:"+base64.StdEncoding.EncodeToString(seed), "")
+
+	token := issueTestToken(t, auth, user).AccessToken
+	if identity, err := auth.Authenticate(context.Background(), token); err != nil || identity.UserId != "u1" {
+		t.Errorf("Authenticate = %+v, %v, want user u1", identity, err)
+	}
+	hs := newTestJWTAuthenticator(t, store, "HS256", "ed:"+testJWTSecret("a"), "")
+	if _, err := hs.Authenticate(context.Background(), token); !errors.Is(err, errInvalidToken) {
+		t.Errorf("HS256 authenticator accepted an EdDSA token: %v", err)
+	}
+}
+
+func TestJWTRefreshTokenReuse(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	user := mustRegister(t, store, "u1", "alice")
+	auth := newTestJWTAuthenticator(t, store, "HS256", "k1:"+testJWTSecret("a"), "")
+
+	first := issueTestToken(t, auth, user).RefreshToken
+	second, err := auth.Refresh(ctx, first)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if second.RefreshToken == first {
+		t.Fatal("Refresh did not rotate the refresh token")
+	}
+
+	// Presenting the rotated-out token means it leaked: the session goes.
+	if _, err := auth.Refresh(ctx, first); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("Refresh with a reused token = %v, want errInvalidRefreshToken", err)
+	}
+	if _, err := auth.Refresh(ctx, second.RefreshToken); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("Refresh after reuse detection = %v, want the session revoked", err)
+	}
+	id, _, _ := strings.Cut(first, ".")
+	_, err = store.GetRefreshToken(ctx, id)
+	mustBeMissing(t, err, "refresh token after reuse detection")
+}
+
+func TestJWTRefreshRejects(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	user := mustRegister(t, store, "u1", "alice")
+	auth := newTestJWTAuthenticator(t, store, "HS256", "k1:"+testJWTSecret("a"), "")
+	valid := issueTestToken(t, auth, user).RefreshToken
+	id, _, _ := strings.Cut(valid, ".")
+
+	disabled := mustRegister(t, store, "u2", "bob")
+	disabledToken := issueTestToken(t, auth, disabled).RefreshToken
+	must(t, store.SetUserDisabled(ctx, "u2", true))
+
+	expiredToken := issueTestToken(t, auth, user).RefreshToken
+	expiredId, _, _ := strings.Cut(expiredToken, ".")
+	expired, err := store.GetRefreshToken(ctx, expiredId)
+	must(t, err)
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	must(t, store.SetRefreshToken(ctx, expired))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"no separator", "garbage"},
+		{"unknown session", "unknown.secret"},
+		{"expired", expiredToken},
+		{"disabled user", disabledToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := auth.Refresh(ctx, tt.token); !errors.Is(err, errInvalidRefreshToken) {
+				t.Errorf("Refresh = %v, want errInvalidRefreshToken", err)
+			}
+		})
+	}
+
+	// None of the rejections touched the valid session.
+	if _, err := store.GetRefreshToken(ctx, id); err != nil {
+		t.Errorf("valid refresh token was affected: %v", err)
+	}
+}
+
+func TestNewJWTAuthenticatorRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		algorithm  string
+		keys       string
+		signingKid string
+	}{
+		{"unsupported algorithm", "RS256", "k1:" + testJWTSecret("a"), ""},
+		{"no keys", "HS256", "", ""},
+		{"missing kid", "HS256", testJWTSecret("a"), ""},
+		{"invalid base64", "HS256", "k1:%%%", ""},
+		{"short HS256 secret", "HS256", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"bad EdDSA key size", "EdDSA", "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), ""},
+		{"unlisted signing key", "HS256", "k1:" + testJWTSecret("a"), "k2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJWTAuthenticator(NewInMemoryStorage(), Config{JWTAlgorithm: tt.algorithm, JWTKeys: tt.keys, JWTSigningKeyID: tt.signingKid})
+			if err == nil {
+				t.Error("newJWTAuthenticator succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestRequestIDReachesQueue checks that the worker gets the ID of the
+// request that queued its task, so that both services log it.
+func TestRequestIDReachesQueue(t *testing.T) {
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	queue := &fakeQueue{}
+	r := chi.NewRouter()
+	r.Use(requestIDMiddleware)
+	r.Post("/task", func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u1"}))
+		CreateTaskHandler(queue, store, store, store, store, Config{UploadLimits: UploadLimits{MaxBytes: 1 << 20}, ResultRetention: ResultRetention{Default: time.Hour}}).ServeHTTP(w, r)
+	})
+
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"sent by the client", "req-42", true},
+		{"malformed", "req 42", false},
+		{"none", "", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := uploadRequest(t, "/task", testPNG(t, 8, 8))
+			if tt.sent != "" {
+				req.Header.Set(requestIDHeader, tt.sent)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+			}
+
+			id := w.Header().Get(requestIDHeader)
+			if (id == tt.sent) != tt.kept || id == "" {
+				t.Errorf("request ID %q for %q, want it kept: %v", id, tt.sent, tt.kept)
+			}
+			messages := queue.messages()
+			if len(messages) != i+1 {
+				t.Fatalf("%d messages queued, want %d", len(messages), i+1)
+			}
+			if got := messages[i].Headers[requestIDHeader]; got != id {
+				t.Errorf("message header %s = %v, want %q", requestIDHeader, got, id)
+			}
+		})
+	}
+}
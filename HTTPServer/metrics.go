@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	tasksCreatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tasks_created_total",
+		Help: "Tasks created by filter pipeline and whether the result came from the result cache.",
+	}, []string{"filter", "cached"})
+	tasksCompletedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tasks_completed_total",
+		Help: "Tasks committed by the imageProcessor, by status.",
+	}, []string{"status"})
+)
+
+// maxFilterLabels bounds the distinct filter label values: pipelines come
+// from clients, and every label value is a new time series.
+const maxFilterLabels = 50
+
+var filterLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// filterLabel returns the pipeline as a label value, or "other" once
+// maxFilterLabels distinct pipelines have been seen.
+func filterLabel(pipeline string) string {
+	filterLabels.Lock()
+	defer filterLabels.Unlock()
+	if filterLabels.seen[pipeline] {
+		return pipeline
+	}
+	if len(filterLabels.seen) >= maxFilterLabels || parsePipeline(pipeline) != nil {
+		return "other"
+	}
+	filterLabels.seen[pipeline] = true
+	return pipeline
+}
+
+// statusLabel keeps the status label to the values the worker reports.
+func statusLabel(status string) string {
+	if status != "ready" && status != "failed" {
+		return "other"
+	}
+	return status
+}
+
+// metricsMiddleware counts requests and measures their latency. Routes are
+// labelled by pattern, such as /status/{taskID}, to keep the number of
+// series bounded.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			route := chi.RouteContext(r.Context()).RoutePattern()
+			if route == "" {
+				route = "unmatched"
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			httpRequestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue reads the counter with exactly the given labels from the
+// default registry, or 0 if it has no such series.
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	must(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestFilterLabel(t *testing.T) {
+	filterLabels.Lock()
+	saved := filterLabels.seen
+	filterLabels.seen = make(map[string]bool)
+	filterLabels.Unlock()
+	t.Cleanup(func() {
+		filterLabels.Lock()
+		filterLabels.seen = saved
+		filterLabels.Unlock()
+	})
+
+	if got := filterLabel("blur,sharpen"); got != "blur,sharpen" {
+		t.Errorf("filterLabel(blur,sharpen) = %q, want the pipeline", got)
+	}
+	for _, pipeline := range []string{"Blur", "blur,", "blur;drop table", ""} {
+		if got := filterLabel(pipeline); got != "other" {
+			t.Errorf("filterLabel(%q) = %q, want other", pipeline, got)
+		}
+	}
+	for i := 1; i < maxFilterLabels; i++ {
+		filterLabel(fmt.Sprintf("f%d", i))
+	}
+	if got := filterLabel("one-too-many"); got != "other" {
+		t.Errorf("pipeline over the cap = %q, want other", got)
+	}
+	// Pipelines seen before the cap was reached keep their label.
+	if got := filterLabel("blur,sharpen"); got != "blur,sharpen" {
+		t.Errorf("filterLabel(blur,sharpen) after the cap = %q, want the pipeline", got)
+	}
+}
+
+func TestMetricsMiddlewareRouteLabel(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(metricsMiddleware)
+	r.NotFound(notFoundHandler)
+	r.Get("/metrics-test/{taskID}", func(w http.ResponseWriter, r *http.Request) {})
+
+	matched := map[string]string{"method": "GET", "route": "/metrics-test/{taskID}", "code": "200"}
+	unmatched := map[string]string{"method": "GET", "route": "unmatched", "code": "404"}
+	matchedBefore := counterValue(t, "http_requests_total", matched)
+	unmatchedBefore := counterValue(t, "http_requests_total", unmatched)
+
+	for _, target := range []string{"/metrics-test/t1", "/metrics-test/t2", "/scan/1", "/scan/2", "/scan/3"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	if got := counterValue(t, "http_requests_total", matched) - matchedBefore; got != 2 {
+		t.Errorf("requests labelled with the route pattern = %v, want 2", got)
+	}
+	if got := counterValue(t, "http_requests_total", unmatched) - unmatchedBefore; got != 3 {
+		t.Errorf("requests labelled unmatched = %v, want 3", got)
+	}
+	for _, route := range []string{"/metrics-test/t1", "/scan/1"} {
+		if got := counterValue(t, "http_requests_total", map[string]string{"method": "GET", "route": route, "code": "200"}) +
+			counterValue(t, "http_requests_total", map[string]string{"method": "GET", "route": route, "code": "404"}); got != 0 {
+			t.Errorf("series for the raw path %s", route)
+		}
+	}
+}
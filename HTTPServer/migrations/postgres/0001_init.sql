@@ -0,0 +1,60 @@
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    login      TEXT NOT NULL UNIQUE,
+    hash       TEXT NOT NULL,
+    role       TEXT NOT NULL DEFAULT 'user',
+    disabled   BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE sessions (
+    id              TEXT PRIMARY KEY,
+    user_id         TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ NOT NULL,
+    last_seen_at    TIMESTAMPTZ NOT NULL,
+    expires_at      TIMESTAMPTZ,
+    idle_timeout_us BIGINT NOT NULL DEFAULT 0,
+    user_agent      TEXT NOT NULL DEFAULT '',
+    remote_addr     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE refresh_tokens (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    hash         TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    user_agent   TEXT NOT NULL DEFAULT '',
+    remote_addr  TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+CREATE TABLE api_keys (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL,
+    hash         TEXT NOT NULL UNIQUE,
+    scopes       TEXT[] NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL,
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX api_keys_user_id_idx ON api_keys (user_id);
+
+CREATE TABLE tasks (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT REFERENCES users (id) ON DELETE CASCADE,
+    filter_name TEXT NOT NULL DEFAULT '',
+    status      TEXT NOT NULL,
+    result      TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX tasks_user_id_idx ON tasks (user_id);
+CREATE INDEX tasks_created_at_idx ON tasks (created_at);
@@ -0,0 +1,6 @@
+ALTER TABLE tasks
+    ADD COLUMN result_ttl_us BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN completed_at  TIMESTAMPTZ,
+    ADD COLUMN expires_at    TIMESTAMPTZ;
+
+CREATE INDEX tasks_expires_at_idx ON tasks (expires_at) WHERE status = 'ready';
@@ -0,0 +1,9 @@
+CREATE TABLE usage (
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    day          DATE NOT NULL,
+    tasks        BIGINT NOT NULL DEFAULT 0,
+    input_bytes  BIGINT NOT NULL DEFAULT 0,
+    output_bytes BIGINT NOT NULL DEFAULT 0,
+    cpu_time_us  BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
@@ -0,0 +1,11 @@
+ALTER TABLE tasks ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE result_cache (
+    content_hash TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    result       TEXT NOT NULL,
+    expires_at   TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX result_cache_user_id_idx ON result_cache (user_id);
+CREATE INDEX result_cache_expires_at_idx ON result_cache (expires_at);
@@ -0,0 +1,10 @@
+CREATE TABLE idempotency_keys (
+    user_id     TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    key         TEXT NOT NULL,
+    task_id     TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1 @@
+ALTER TABLE tasks ADD COLUMN source_id TEXT NOT NULL DEFAULT '';
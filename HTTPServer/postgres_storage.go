@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// PostgresStorage keeps users, sessions and tasks in PostgreSQL.
+type PostgresStorage struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStorage connects to the database and applies any pending
+// migrations.
+func NewPostgresStorage(ctx context.Context, dsn string) (*PostgresStorage, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &PostgresStorage{pool: pool}, nil
+}
+
+func (s *PostgresStorage) Close() {
+	s.pool.Close()
+}
+
+func (s *PostgresStorage) Ping(ctx context.Context) error {
+	return postgresError("ping", s.pool.Ping(ctx))
+}
+
+// migratePostgres applies the embedded migrations that are not recorded in
+// schema_migrations yet, each in its own transaction. An advisory lock keeps
+// replicas that start at the same time from racing each other.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	names, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock(7120364)`); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock(7120364)`)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, name := range names {
+		version := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".sql")
+		var applied bool
+		err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		script, err := postgresMigrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, string(script)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", version, err)
+		}
+		slog.Info("Applied migration", "version", version)
+	}
+	return nil
+}
+
+// postgresError maps pgx.ErrNoRows to ErrNotFound and wraps everything
+// else with the operation that failed.
+func postgresError(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound
+	default:
+		return &StorageError{Op: "postgres " + op, Err: err}
+	}
+}
+
+// exec runs a statement and returns the number of affected rows.
+func (s *PostgresStorage) exec(ctx context.Context, op string, sql string, args ...any) (int, error) {
+	tag, err := s.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, postgresError(op, err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// execOne runs a statement that should affect a row and returns ErrNotFound
+// if it did not.
+func (s *PostgresStorage) execOne(ctx context.Context, op string, sql string, args ...any) error {
+	affected, err := s.exec(ctx, op, sql, args...)
+	if err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func queryAll[T any](ctx context.Context, pool *pgxpool.Pool, op string, scan func(pgx.Row) (T, error), sql string, args ...any) ([]T, error) {
+	rows, err := pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, postgresError(op, err)
+	}
+	values, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (T, error) {
+		return scan(row)
+	})
+	return values, postgresError(op, err)
+}
+
+// nullTime maps the zero time to NULL.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+const taskColumns = `id, COALESCE(user_id, ''), filter_name, status, result, created_at, result_ttl_us, completed_at, expires_at, content_hash, source_id, result_etag`
+
+func scanTask(row pgx.Row) (Task, error) {
+	var task Task
+	var resultTTL int64
+	var completedAt, expiresAt *time.Time
+	err := row.Scan(&task.Id, &task.UserId, &task.FilterName, &task.Status, &task.Result, &task.CreatedAt,
+		&resultTTL, &completedAt, &expiresAt, &task.ContentHash, &task.SourceId, &task.ResultETag)
+	task.ResultTTL = time.Duration(resultTTL) * time.Microsecond
+	task.CompletedAt = timeOrZero(completedAt)
+	task.ExpiresAt = timeOrZero(expiresAt)
+	return task, err
+}
+
+func (s *PostgresStorage) SetTask(ctx context.Context, task Task) error {
+	_, err := s.exec(ctx, "set task", `
+		INSERT INTO tasks (id, user_id, filter_name, status, result, created_at, result_ttl_us, completed_at, expires_at, content_hash, source_id, result_etag)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			filter_name = EXCLUDED.filter_name,
+			status = EXCLUDED.status,
+			result = EXCLUDED.result,
+			created_at = EXCLUDED.created_at,
+			result_ttl_us = EXCLUDED.result_ttl_us,
+			completed_at = EXCLUDED.completed_at,
+			expires_at = EXCLUDED.expires_at,
+			content_hash = EXCLUDED.content_hash,
+			source_id = EXCLUDED.source_id,
+			result_etag = EXCLUDED.result_etag`,
+		task.Id, nullString(task.UserId), task.FilterName, task.Status, task.Result, task.CreatedAt,
+		task.ResultTTL.Microseconds(), nullTime(task.CompletedAt), nullTime(task.ExpiresAt), task.ContentHash, task.SourceId, task.ResultETag)
+	return err
+}
+
+func (s *PostgresStorage) GetTask(ctx context.Context, id string) (Task, error) {
+	task, err := scanTask(s.pool.QueryRow(ctx, `SELECT `+taskColumns+` FROM tasks WHERE id = $1`, id))
+	return task, postgresError("get task", err)
+}
+
+func (s *PostgresStorage) GetTasks(ctx context.Context) ([]Task, error) {
+	return queryAll(ctx, s.pool, "get tasks", scanTask, `SELECT `+taskColumns+` FROM tasks`)
+}
+
+func (s *PostgresStorage) DeleteTasks(ctx context.Context, status string, createdBefore time.Time) (int, error) {
+	return s.exec(ctx, "delete tasks",
+		`DELETE FROM tasks WHERE ($1 = '' OR status = $1) AND created_at < $2`,
+		status, createdBefore)
+}
+
+func (s *PostgresStorage) DeleteExpiredResults(ctx context.Context, now time.Time) (int, error) {
+	deleted, err := s.exec(ctx, "delete expired results",
+		`DELETE FROM tasks WHERE status = 'ready' AND expires_at <= $1 AND source_id <> ''`,
+		now)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := s.exec(ctx, "delete expired results",
+		`UPDATE tasks SET status = 'expired', result = '', result_etag = '' WHERE status = 'ready' AND expires_at <= $1`,
+		now)
+	return deleted + expired, err
+}
+
+func (s *PostgresStorage) AddUsage(ctx context.Context, UserId string, at time.Time, delta Usage) error {
+	_, err := s.exec(ctx, "add usage", `
+		INSERT INTO usage (user_id, day, tasks, input_bytes, output_bytes, cpu_time_us)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			tasks = usage.tasks + EXCLUDED.tasks,
+			input_bytes = usage.input_bytes + EXCLUDED.input_bytes,
+			output_bytes = usage.output_bytes + EXCLUDED.output_bytes,
+			cpu_time_us = usage.cpu_time_us + EXCLUDED.cpu_time_us`,
+		UserId, usageDay(at), delta.Tasks, delta.InputBytes, delta.OutputBytes, delta.CPUTime.Microseconds())
+	return err
+}
+
+func (s *PostgresStorage) GetUsage(ctx context.Context, UserId string, from time.Time, to time.Time) (Usage, error) {
+	var usage Usage
+	var cpuTime int64
+	first, end := usageDays(from, to)
+	err := s.pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(tasks), 0)::BIGINT, COALESCE(SUM(input_bytes), 0)::BIGINT,
+		       COALESCE(SUM(output_bytes), 0)::BIGINT, COALESCE(SUM(cpu_time_us), 0)::BIGINT
+		FROM usage WHERE user_id = $1 AND day >= $2 AND day < $3`,
+		UserId, first, end).Scan(&usage.Tasks, &usage.InputBytes, &usage.OutputBytes, &cpuTime)
+	usage.CPUTime = time.Duration(cpuTime) * time.Microsecond
+	return usage, postgresError("get usage", err)
+}
+
+const idempotencyKeyColumns = `user_id, key, task_id, fingerprint, expires_at`
+
+func scanIdempotencyKey(row pgx.Row) (IdempotencyKey, error) {
+	var key IdempotencyKey
+	err := row.Scan(&key.UserId, &key.Key, &key.TaskId, &key.Fingerprint, &key.ExpiresAt)
+	return key, err
+}
+
+func (s *PostgresStorage) ClaimIdempotencyKey(ctx context.Context, key IdempotencyKey, now time.Time) (IdempotencyKey, error) {
+	// The upsert only replaces expired keys. If it returns nothing, an
+	// unexpired key exists; it is read in a separate statement so that the
+	// read sees a key committed concurrently.
+	claimed, err := scanIdempotencyKey(s.pool.QueryRow(ctx, `
+		INSERT INTO idempotency_keys (`+idempotencyKeyColumns+`)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE SET
+			task_id = EXCLUDED.task_id,
+			fingerprint = EXCLUDED.fingerprint,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= $6
+		RETURNING `+idempotencyKeyColumns,
+		key.UserId, key.Key, key.TaskId, key.Fingerprint, key.ExpiresAt, now))
+	if errors.Is(err, pgx.ErrNoRows) {
+		claimed, err = scanIdempotencyKey(s.pool.QueryRow(ctx,
+			`SELECT `+idempotencyKeyColumns+` FROM idempotency_keys WHERE user_id = $1 AND key = $2`,
+			key.UserId, key.Key))
+	}
+	return claimed, postgresError("claim idempotency key", err)
+}
+
+func (s *PostgresStorage) DeleteIdempotencyKey(ctx context.Context, UserId string, key string) error {
+	_, err := s.exec(ctx, "delete idempotency key", `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`, UserId, key)
+	return err
+}
+
+func (s *PostgresStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	return s.exec(ctx, "delete expired idempotency keys", `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+}
+
+const cachedResultColumns = `content_hash, user_id, result, expires_at`
+
+func (s *PostgresStorage) SetCachedResult(ctx context.Context, entry CachedResult) error {
+	_, err := s.exec(ctx, "set cached result", `
+		INSERT INTO result_cache (`+cachedResultColumns+`)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (content_hash) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			result = EXCLUDED.result,
+			expires_at = EXCLUDED.expires_at`,
+		entry.ContentHash, entry.UserId, entry.Result, entry.ExpiresAt)
+	return err
+}
+
+func (s *PostgresStorage) GetCachedResult(ctx context.Context, hash string, now time.Time) (CachedResult, error) {
+	var entry CachedResult
+	err := s.pool.QueryRow(ctx,
+		`SELECT `+cachedResultColumns+` FROM result_cache WHERE content_hash = $1 AND expires_at > $2`,
+		hash, now).Scan(&entry.ContentHash, &entry.UserId, &entry.Result, &entry.ExpiresAt)
+	return entry, postgresError("get cached result", err)
+}
+
+func (s *PostgresStorage) DeleteExpiredCachedResults(ctx context.Context, now time.Time) (int, error) {
+	return s.exec(ctx, "delete expired cached results", `DELETE FROM result_cache WHERE expires_at <= $1`, now)
+}
+
+const userColumns = `id, login, hash, role, disabled, created_at`
+
+func scanUser(row pgx.Row) (User, error) {
+	var user User
+	err := row.Scan(&user.id, &user.login, &user.hash, &user.role, &user.disabled, &user.createdAt)
+	return user, err
+}
+
+func (s *PostgresStorage) RegisterUser(ctx context.Context, id string, username string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	_, err = s.pool.Exec(ctx, `
+		INSERT INTO users (id, login, hash, role, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		id, username, string(hashedPassword), RoleUser, time.Now())
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrUserExists
+	}
+	return postgresError("register user", err)
+}
+
+func (s *PostgresStorage) GetUserByLogin(ctx context.Context, login string) (User, error) {
+	user, err := scanUser(s.pool.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE login = $1`, login))
+	return user, postgresError("get user by login", err)
+}
+
+func (s *PostgresStorage) GetUserById(ctx context.Context, id string) (User, error) {
+	user, err := scanUser(s.pool.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	return user, postgresError("get user by id", err)
+}
+
+func (s *PostgresStorage) GetUsers(ctx context.Context) ([]User, error) {
+	return queryAll(ctx, s.pool, "get users", scanUser, `SELECT `+userColumns+` FROM users`)
+}
+
+func (s *PostgresStorage) SetUserRole(ctx context.Context, id string, role string) error {
+	return s.execOne(ctx, "set user role", `UPDATE users SET role = $2 WHERE id = $1`, id, role)
+}
+
+func (s *PostgresStorage) SetUserDisabled(ctx context.Context, id string, disabled bool) error {
+	return s.execOne(ctx, "set user disabled", `UPDATE users SET disabled = $2 WHERE id = $1`, id, disabled)
+}
+
+func (s *PostgresStorage) SetUserPassword(ctx context.Context, id string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	return s.execOne(ctx, "set user password", `UPDATE users SET hash = $2 WHERE id = $1`, id, string(hashedPassword))
+}
+
+// DeleteUser removes the user; sessions, refresh tokens, API keys, tasks,
+// usage and idempotency keys go with it through ON DELETE CASCADE.
+func (s *PostgresStorage) DeleteUser(ctx context.Context, id string) error {
+	return s.execOne(ctx, "delete user", `DELETE FROM users WHERE id = $1`, id)
+}
+
+const sessionColumns = `id, user_id, created_at, last_seen_at, expires_at, idle_timeout_us, user_agent, remote_addr`
+
+func scanSession(row pgx.Row) (Session, error) {
+	var session Session
+	var expiresAt *time.Time
+	var idleTimeout int64
+	err := row.Scan(&session.SessionId, &session.UserId, &session.CreatedAt, &session.LastSeenAt,
+		&expiresAt, &idleTimeout, &session.UserAgent, &session.RemoteAddr)
+	session.ExpiresAt = timeOrZero(expiresAt)
+	session.IdleTimeout = time.Duration(idleTimeout) * time.Microsecond
+	return session, err
+}
+
+func (s *PostgresStorage) SetSession(ctx context.Context, session Session) error {
+	_, err := s.exec(ctx, "set session", `
+		INSERT INTO sessions (`+sessionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			created_at = EXCLUDED.created_at,
+			last_seen_at = EXCLUDED.last_seen_at,
+			expires_at = EXCLUDED.expires_at,
+			idle_timeout_us = EXCLUDED.idle_timeout_us,
+			user_agent = EXCLUDED.user_agent,
+			remote_addr = EXCLUDED.remote_addr`,
+		session.SessionId, session.UserId, session.CreatedAt, session.LastSeenAt,
+		nullTime(session.ExpiresAt), session.IdleTimeout.Microseconds(), session.UserAgent, session.RemoteAddr)
+	return err
+}
+
+func (s *PostgresStorage) GetSession(ctx context.Context, SessionId string) (Session, error) {
+	session, err := scanSession(s.pool.QueryRow(ctx, `SELECT `+sessionColumns+` FROM sessions WHERE id = $1`, SessionId))
+	if err != nil {
+		return Session{}, postgresError("get session", err)
+	}
+	if session.Expired(time.Now()) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *PostgresStorage) TouchSession(ctx context.Context, SessionId string, now time.Time) error {
+	return s.execOne(ctx, "touch session", `UPDATE sessions SET last_seen_at = $2 WHERE id = $1`, SessionId, now)
+}
+
+func (s *PostgresStorage) DeleteSession(ctx context.Context, SessionId string) error {
+	_, err := s.exec(ctx, "delete session", `DELETE FROM sessions WHERE id = $1`, SessionId)
+	return err
+}
+
+func (s *PostgresStorage) GetUserSessions(ctx context.Context, UserId string) ([]Session, error) {
+	sessions, err := queryAll(ctx, s.pool, "get user sessions", scanSession,
+		`SELECT `+sessionColumns+` FROM sessions WHERE user_id = $1`, UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := sessions[:0]
+	for _, session := range sessions {
+		if !session.Expired(now) {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+func (s *PostgresStorage) DeleteUserSessions(ctx context.Context, UserId string, keepSessionId string) error {
+	_, err := s.exec(ctx, "delete user sessions", `DELETE FROM sessions WHERE user_id = $1 AND id <> $2`, UserId, keepSessionId)
+	return err
+}
+
+func (s *PostgresStorage) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	return s.exec(ctx, "delete expired sessions", `
+		DELETE FROM sessions
+		WHERE expires_at <= $1
+		   OR (idle_timeout_us > 0 AND last_seen_at + idle_timeout_us * interval '1 microsecond' <= $1)`,
+		now)
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, hash, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row pgx.Row) (APIKey, error) {
+	var key APIKey
+	var expiresAt, lastUsedAt *time.Time
+	err := row.Scan(&key.Id, &key.UserId, &key.Name, &key.Prefix, &key.Hash, &key.Scopes,
+		&key.CreatedAt, &expiresAt, &lastUsedAt)
+	key.ExpiresAt = timeOrZero(expiresAt)
+	key.LastUsedAt = timeOrZero(lastUsedAt)
+	return key, err
+}
+
+func (s *PostgresStorage) SetAPIKey(ctx context.Context, key APIKey) error {
+	_, err := s.exec(ctx, "set api key", `
+		INSERT INTO api_keys (`+apiKeyColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			name = EXCLUDED.name,
+			prefix = EXCLUDED.prefix,
+			hash = EXCLUDED.hash,
+			scopes = EXCLUDED.scopes,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at,
+			last_used_at = EXCLUDED.last_used_at`,
+		key.Id, key.UserId, key.Name, key.Prefix, key.Hash, key.Scopes,
+		key.CreatedAt, nullTime(key.ExpiresAt), nullTime(key.LastUsedAt))
+	return err
+}
+
+func (s *PostgresStorage) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	key, err := scanAPIKey(s.pool.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = $1`, hash))
+	return key, postgresError("get api key", err)
+}
+
+func (s *PostgresStorage) GetUserAPIKeys(ctx context.Context, UserId string) ([]APIKey, error) {
+	return queryAll(ctx, s.pool, "get user api keys", scanAPIKey,
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = $1`, UserId)
+}
+
+func (s *PostgresStorage) TouchAPIKey(ctx context.Context, id string, now time.Time) error {
+	return s.execOne(ctx, "touch api key", `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, now)
+}
+
+func (s *PostgresStorage) DeleteAPIKey(ctx context.Context, UserId string, id string) error {
+	return s.execOne(ctx, "delete api key", `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, UserId)
+}
+
+const refreshTokenColumns = `id, user_id, hash, created_at, last_used_at, expires_at, user_agent, remote_addr`
+
+func scanRefreshToken(row pgx.Row) (RefreshToken, error) {
+	var token RefreshToken
+	err := row.Scan(&token.Id, &token.UserId, &token.Hash, &token.CreatedAt, &token.LastUsedAt,
+		&token.ExpiresAt, &token.UserAgent, &token.RemoteAddr)
+	return token, err
+}
+
+func (s *PostgresStorage) SetRefreshToken(ctx context.Context, token RefreshToken) error {
+	_, err := s.exec(ctx, "set refresh token", `
+		INSERT INTO refresh_tokens (`+refreshTokenColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			hash = EXCLUDED.hash,
+			created_at = EXCLUDED.created_at,
+			last_used_at = EXCLUDED.last_used_at,
+			expires_at = EXCLUDED.expires_at,
+			user_agent = EXCLUDED.user_agent,
+			remote_addr = EXCLUDED.remote_addr`,
+		token.Id, token.UserId, token.Hash, token.CreatedAt, token.LastUsedAt,
+		token.ExpiresAt, token.UserAgent, token.RemoteAddr)
+	return err
+}
+
+func (s *PostgresStorage) GetRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	token, err := scanRefreshToken(s.pool.QueryRow(ctx, `SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = $1`, id))
+	return token, postgresError("get refresh token", err)
+}
+
+func (s *PostgresStorage) RotateRefreshToken(ctx context.Context, id string, oldHash string, newHash string, now time.Time) error {
+	return s.execOne(ctx, "rotate refresh token",
+		`UPDATE refresh_tokens SET hash = $3, last_used_at = $4 WHERE id = $1 AND hash = $2`,
+		id, oldHash, newHash, now)
+}
+
+func (s *PostgresStorage) DeleteRefreshToken(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, "delete refresh token", `DELETE FROM refresh_tokens WHERE id = $1`, id)
+	return err
+}
+
+func (s *PostgresStorage) GetUserRefreshTokens(ctx context.Context, UserId string) ([]RefreshToken, error) {
+	return queryAll(ctx, s.pool, "get user refresh tokens", scanRefreshToken,
+		`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = $1 AND expires_at > $2`,
+		UserId, time.Now())
+}
+
+func (s *PostgresStorage) DeleteUserRefreshTokens(ctx context.Context, UserId string, keepId string) error {
+	_, err := s.exec(ctx, "delete user refresh tokens", `DELETE FROM refresh_tokens WHERE user_id = $1 AND id <> $2`, UserId, keepId)
+	return err
+}
+
+func (s *PostgresStorage) DeleteExpiredRefreshTokens(ctx context.Context, now time.Time) (int, error) {
+	return s.exec(ctx, "delete expired refresh tokens", `DELETE FROM refresh_tokens WHERE expires_at <= $1`, now)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// taskPollInterval is how often waiters re-read a task, to catch results
+// committed to another replica.
+const taskPollInterval = 500 * time.Millisecond
+
+// taskWaiter lets requests wait for tasks to complete. CommitHandler wakes
+// waiters on this replica immediately; waiters also poll storage because the
+// worker may commit through another replica.
+type taskWaiter struct {
+	mu      sync.Mutex
+	waiting map[string][]chan struct{}
+}
+
+func newTaskWaiter() *taskWaiter {
+	return &taskWaiter{waiting: make(map[string][]chan struct{})}
+}
+
+// Notify wakes everyone waiting for the task.
+func (tw *taskWaiter) Notify(taskID string) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, ch := range tw.waiting[taskID] {
+		close(ch)
+	}
+	delete(tw.waiting, taskID)
+}
+
+func (tw *taskWaiter) subscribe(taskID string) <-chan struct{} {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	ch := make(chan struct{})
+	tw.waiting[taskID] = append(tw.waiting[taskID], ch)
+	return ch
+}
+
+func (tw *taskWaiter) unsubscribe(taskID string, done <-chan struct{}) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	waiting := tw.waiting[taskID]
+	for i, ch := range waiting {
+		if ch == done {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(tw.waiting, taskID)
+	} else {
+		tw.waiting[taskID] = waiting
+	}
+}
+
+// Wait returns the task once it is no longer in progress. If ctx ends first
+// it returns the task as last seen together with ctx's error.
+func (tw *taskWaiter) Wait(ctx context.Context, tasks TaskStore, taskID string) (Task, error) {
+	ticker := time.NewTicker(taskPollInterval)
+	defer ticker.Stop()
+	for {
+		// Subscribe before reading so a commit in between is not missed.
+		done := tw.subscribe(taskID)
+		task, err := tasks.GetTask(ctx, taskID)
+		if err != nil || task.Status != "in_progress" {
+			tw.unsubscribe(taskID, done)
+			return task, err
+		}
+		select {
+		case <-done:
+		case <-ticker.C:
+			tw.unsubscribe(taskID, done)
+		case <-ctx.Done():
+			tw.unsubscribe(taskID, done)
+			return task, ctx.Err()
+		}
+	}
+}
+
+// @Summary Process an image synchronously
+// @Description Meant for small images: queues the task like POST /task but waits up to PROCESS_TIMEOUT and returns the processed image directly. If the deadline passes, responds 202 with the task ID to poll /status and /result with. Images are limited to PROCESS_MAX_BYTES.
+// @Accept multipart/form-data
+// @Produce image/png
+// @Produce json
+// @Security BearerAuth
+// @Param image formData file true "Image file"
+// @Param filtername formData string true "Name of the filter"
+// @Param retention formData string false "How long to keep the result after completion, e.g. 2h; defaults to RESULT_TTL"
+// @Param Idempotency-Key header string false "Retries with the same key within IDEMPOTENCY_WINDOW return the original task"
+// @Success 200 {file} file "Processed image in PNG format"
+// @Success 202 {object} TaskResponse "Not done in time; poll /status/{taskID}"
+// @Header 200,202 {string} X-Task-ID "ID of the created task"
+// @Failure 400 {object} ErrorResponse "Invalid form, image, retention or Idempotency-Key"
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Missing scope tasks:write"
+// @Failure 409 {object} ErrorResponse "A request with the same Idempotency-Key is in progress"
+// @Failure 413 {object} ErrorResponse "Image too large, use POST /task"
+// @Failure 415 {object} ErrorResponse "Unsupported image type"
+// @Failure 422 {object} ErrorResponse "Processing failed, or Idempotency-Key was used for a different request"
+// @Failure 429 {object} ErrorResponse "Too many tasks, or daily or monthly quota exceeded"
+// @Failure 503 {object} ErrorResponse "Storage or queue unavailable"
+// @Router /process [post]
+func ProcessHandler(ch taskQueue, tasks TaskStore, usage UsageStore, idempotency IdempotencyStore, cache ResultCacheStore, waiter *taskWaiter, cfg Config) http.HandlerFunc {
+	limits := cfg.UploadLimits
+	limits.MaxBytes = min(limits.MaxBytes, cfg.ProcessMaxBytes)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := submitTask(w, r, ch, tasks, usage, idempotency, cache, cfg, limits)
+		if !ok {
+			return
+		}
+		taskID := task.Id
+		w.Header().Set("X-Task-ID", taskID)
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.ProcessTimeout)
+		defer cancel()
+		task, err := waiter.Wait(ctx, tasks, taskID)
+		switch {
+		case r.Context().Err() != nil:
+			// The client is gone; the task carries on in the background.
+		case errors.Is(err, context.DeadlineExceeded):
+			w.Header().Set("Location", "/status/"+taskID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(TaskResponse{TaskID: taskID})
+		case err != nil:
+			writeStorageError(w, r, err)
+		default:
+			writeResult(w, r, task)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForSubscriber blocks until someone waits for the task, so that a
+// completion after it can only be seen through Notify or polling.
+func waitForSubscriber(t *testing.T, waiter *taskWaiter, taskID string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		waiter.mu.Lock()
+		n := len(waiter.waiting[taskID])
+		waiter.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nobody waits for the task")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTaskWaiterNotify(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	waiter := newTaskWaiter()
+	must(t, store.SetTask(ctx, Task{Id: "t1", Status: "in_progress"}))
+
+	type result struct {
+		task    Task
+		err     error
+		elapsed time.Duration
+	}
+	done := make(chan result)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		task, err := waiter.Wait(ctx, store, "t1")
+		done <- result{task, err, time.Since(start)}
+	}()
+
+	waitForSubscriber(t, waiter, "t1")
+	must(t, store.SetTask(ctx, Task{Id: "t1", Status: "ready"}))
+	waiter.Notify("t1")
+	got := <-done
+	if got.err != nil || got.task.Status != "ready" {
+		t.Fatalf("Wait = %+v, %v, want the ready task", got.task, got.err)
+	}
+	if got.elapsed >= taskPollInterval {
+		t.Errorf("Wait returned after %v, want Notify to wake it before the %v poll", got.elapsed, taskPollInterval)
+	}
+	if len(waiter.waiting) != 0 {
+		t.Errorf("%d tasks still have waiters", len(waiter.waiting))
+	}
+}
+
+// TestProcessHandler retries a /process request whose task is in progress,
+// so that the handler waits for the task without queueing a new one.
+func TestProcessHandler(t *testing.T) {
+	ctx := context.Background()
+	image := testPNG(t, 8, 8)
+	output := testPNG(t, 4, 4)
+	cfg := Config{
+		UploadLimits:      UploadLimits{MaxBytes: 1 << 20},
+		ProcessMaxBytes:   1 << 20,
+		ProcessTimeout:    2 * time.Second,
+		IdempotencyWindow: time.Hour,
+	}
+
+	setup := func(t *testing.T, cfg Config) (*InMemoryStorage, *taskWaiter, http.Handler) {
+		store := NewInMemoryStorage()
+		mustRegister(t, store, "u1", "alice")
+		now := time.Now()
+		task := Task{Id: "t1", UserId: "u1", FilterName: "blur", CreatedAt: now, Status: "in_progress", ContentHash: contentHash("u1", "blur", image)}
+		must(t, store.SetTask(ctx, task))
+		_, err := store.ClaimIdempotencyKey(ctx, IdempotencyKey{
+			UserId: "u1", Key: "k1", TaskId: "t1", Fingerprint: idempotencyFingerprint(task), ExpiresAt: now.Add(time.Hour),
+		}, now)
+		must(t, err)
+		waiter := newTaskWaiter()
+		return store, waiter, ProcessHandler(nil, store, store, store, store, waiter, cfg)
+	}
+	request := func(image []byte) *http.Request {
+		r := uploadRequest(t, "/process", image)
+		r.Header.Set(idempotencyKeyHeader, "k1")
+		return r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u1"}))
+	}
+
+	t.Run("completed in time", func(t *testing.T) {
+		store, waiter, handler := setup(t, cfg)
+		go func() {
+			waitForSubscriber(t, waiter, "t1")
+			task, err := store.GetTask(ctx, "t1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			task.Status = "ready"
+			task.Result = base64.StdEncoding.EncodeToString(output)
+			if err := store.SetTask(ctx, completeTask(task, time.Now())); err != nil {
+				t.Error(err)
+			}
+			waiter.Notify("t1")
+		}()
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request(image))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+		}
+		if !bytes.Equal(w.Body.Bytes(), output) {
+			t.Error("body is not the processed image")
+		}
+		if got := w.Header().Get("X-Task-ID"); got != "t1" {
+			t.Errorf("X-Task-ID = %q, want t1", got)
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		cfg := cfg
+		cfg.ProcessTimeout = 50 * time.Millisecond
+		_, _, handler := setup(t, cfg)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request(image))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status %d, want 202: %s", w.Code, w.Body)
+		}
+		var response TaskResponse
+		must(t, json.NewDecoder(w.Body).Decode(&response))
+		if response.TaskID != "t1" || w.Header().Get("X-Task-ID") != "t1" || w.Header().Get("Location") != "/status/t1" {
+			t.Errorf("task %q, X-Task-ID %q, Location %q, want t1 and /status/t1", response.TaskID, w.Header().Get("X-Task-ID"), w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("over PROCESS_MAX_BYTES", func(t *testing.T) {
+		cfg := cfg
+		cfg.ProcessMaxBytes = int64(len(image) - 1)
+		store, _, handler := setup(t, cfg)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request(image))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("status %d, want 413: %s", w.Code, w.Body)
+		}
+		var response ErrorResponse
+		must(t, json.NewDecoder(w.Body).Decode(&response))
+		if response.Code != "image_too_large" {
+			t.Errorf("error %s, want image_too_large", response.Code)
+		}
+		if tasks, err := store.GetTasks(ctx); err != nil || len(tasks) != 1 {
+			t.Errorf("GetTasks = %d tasks, %v, want only the original", len(tasks), err)
+		}
+	})
+}
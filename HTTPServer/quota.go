@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Quota caps usage over a period. Zero fields are unlimited.
+type Quota struct {
+	Tasks       int64
+	InputBytes  int64
+	OutputBytes int64
+	CPUTime     time.Duration
+}
+
+// Quotas are the limits every user other than admins is held to. Days and
+// months are UTC.
+type Quotas struct {
+	Daily   Quota
+	Monthly Quota
+}
+
+// usagePeriod is a UTC day or month.
+type usagePeriod struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+func usagePeriods(now time.Time) (day usagePeriod, month usagePeriod) {
+	dayStart := usageDay(now)
+	monthStart := dayStart.AddDate(0, 0, 1-dayStart.Day())
+	return usagePeriod{name: "daily", start: dayStart, end: dayStart.AddDate(0, 0, 1)},
+		usagePeriod{name: "monthly", start: monthStart, end: monthStart.AddDate(0, 1, 0)}
+}
+
+// exceeded names the first limit that used, which already counts the new
+// task, breaks, or returns "" if it fits. Output and CPU time are only known
+// once tasks complete, so they block new tasks once used up.
+func (q Quota) exceeded(used Usage) string {
+	switch {
+	case q.Tasks > 0 && used.Tasks > q.Tasks:
+		return "tasks"
+	case q.InputBytes > 0 && used.InputBytes > q.InputBytes:
+		return "input bytes"
+	case q.OutputBytes > 0 && used.OutputBytes >= q.OutputBytes:
+		return "output bytes"
+	case q.CPUTime > 0 && used.CPUTime >= q.CPUTime:
+		return "CPU time"
+	default:
+		return ""
+	}
+}
+
+// quotaError reports which quota a new task would exceed and when the
+// period resets.
+type quotaError struct {
+	period string
+	limit  string
+	reset  time.Time
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %s", e.period, e.limit)
+}
+
+// reserveQuota counts a new task with inputBytes of input in the user's
+// usage first and checks the quotas against the total afterwards, so that
+// concurrent submissions cannot all pass the check before any of them is
+// counted. If the task does not fit, the reservation is rolled back and a
+// *quotaError returned; otherwise release rolls it back for a task that is
+// not created after all. Admins are counted but not limited.
+func reserveQuota(ctx context.Context, identity Identity, usage UsageStore, quotas Quotas, inputBytes int64, now time.Time) (release func(), err error) {
+	if err := usage.AddUsage(ctx, identity.UserId, now, Usage{Tasks: 1, InputBytes: inputBytes}); err != nil {
+		return nil, err
+	}
+	release = func() {
+		// The rollback must happen even if the client is gone.
+		ctx := context.WithoutCancel(ctx)
+		if err := usage.AddUsage(ctx, identity.UserId, now, Usage{Tasks: -1, InputBytes: -inputBytes}); err != nil {
+			loggerFromContext(ctx).Error("Failed to release reserved usage", "error", err)
+		}
+	}
+	if identity.Role == RoleAdmin {
+		return release, nil
+	}
+
+	day, month := usagePeriods(now)
+	for _, check := range []struct {
+		period usagePeriod
+		quota  Quota
+	}{{day, quotas.Daily}, {month, quotas.Monthly}} {
+		if check.quota == (Quota{}) {
+			continue
+		}
+		used, err := usage.GetUsage(ctx, identity.UserId, check.period.start, check.period.end)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if limit := check.quota.exceeded(used); limit != "" {
+			release()
+			return nil, &quotaError{period: check.period.name, limit: limit, reset: check.period.end}
+		}
+	}
+	return release, nil
+}
+
+type UsageCounters struct {
+	Tasks       int64 `json:"tasks"`
+	InputBytes  int64 `json:"input_bytes"`
+	OutputBytes int64 `json:"output_bytes"`
+	CPUTimeMs   int64 `json:"cpu_time_ms"`
+}
+
+func usageCounters(u Usage) UsageCounters {
+	return UsageCounters{
+		Tasks:       u.Tasks,
+		InputBytes:  u.InputBytes,
+		OutputBytes: u.OutputBytes,
+		CPUTimeMs:   u.CPUTime.Milliseconds(),
+	}
+}
+
+type UsagePeriodResponse struct {
+	Start   time.Time     `json:"start"`
+	ResetAt time.Time     `json:"reset_at"`
+	Used    UsageCounters `json:"used"`
+	// Limit is zero for unlimited counters.
+	Limit UsageCounters `json:"limit"`
+}
+
+type UsageResponse struct {
+	Daily   UsagePeriodResponse `json:"daily"`
+	Monthly UsagePeriodResponse `json:"monthly"`
+}
+
+// @Summary Get usage and quotas
+// @Description Returns what the current user consumed today and this month (UTC) and the quotas that apply. A limit of 0 is unlimited.
+// @tags account
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} UsageResponse
+// @Failure 401 {object} ErrorResponse "Invalid token"
+// @Failure 403 {object} ErrorResponse "Missing scope tasks:read"
+// @Failure 503 {object} ErrorResponse "Storage unavailable"
+// @Router /usage [get]
+func UsageHandler(usage UsageStore, quotas Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := identityFromContext(r.Context()).UserId
+		day, month := usagePeriods(time.Now())
+
+		var response UsageResponse
+		for _, period := range []struct {
+			period   usagePeriod
+			quota    Quota
+			response *UsagePeriodResponse
+		}{{day, quotas.Daily, &response.Daily}, {month, quotas.Monthly, &response.Monthly}} {
+			used, err := usage.GetUsage(r.Context(), userID, period.period.start, period.period.end)
+			if err != nil {
+				writeStorageError(w, r, err)
+				return
+			}
+			*period.response = UsagePeriodResponse{
+				Start:   period.period.start,
+				ResetAt: period.period.end,
+				Used:    usageCounters(used),
+				Limit:   usageCounters(Usage(period.quota)),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReserveQuota(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	day, month := usagePeriods(now)
+	quotas := Quotas{
+		Daily:   Quota{Tasks: 2},
+		Monthly: Quota{InputBytes: 250, OutputBytes: 1000},
+	}
+
+	usedToday := func(t *testing.T, store Storage, userID string) Usage {
+		t.Helper()
+		used, err := store.GetUsage(ctx, userID, day.start, day.end)
+		must(t, err)
+		return used
+	}
+
+	t.Run("daily tasks", func(t *testing.T) {
+		store := NewInMemoryStorage()
+		user := Identity{UserId: "u1"}
+		for i := range 2 {
+			if _, err := reserveQuota(ctx, user, store, quotas, 10, now); err != nil {
+				t.Fatalf("task %d: %v", i, err)
+			}
+		}
+		_, err := reserveQuota(ctx, user, store, quotas, 10, now)
+		var quotaErr *quotaError
+		if !errors.As(err, &quotaErr) || quotaErr.period != "daily" || quotaErr.limit != "tasks" || !quotaErr.reset.Equal(day.end) {
+			t.Fatalf("third task: %v, want the daily tasks quota resetting at %v", err, day.end)
+		}
+		if used := usedToday(t, store, "u1"); used.Tasks != 2 || used.InputBytes != 20 {
+			t.Errorf("usage = %+v, want the rejected task rolled back", used)
+		}
+	})
+
+	t.Run("monthly input bytes", func(t *testing.T) {
+		store := NewInMemoryStorage()
+		must(t, store.AddUsage(ctx, "u1", month.start, Usage{InputBytes: 200}))
+		user := Identity{UserId: "u1"}
+		if _, err := reserveQuota(ctx, user, store, quotas, 50, now); err != nil {
+			t.Fatalf("task filling the quota: %v", err)
+		}
+		var quotaErr *quotaError
+		if _, err := reserveQuota(ctx, user, store, quotas, 1, now); !errors.As(err, &quotaErr) || quotaErr.limit != "input bytes" {
+			t.Errorf("task over the quota: %v, want the input bytes quota", err)
+		}
+	})
+
+	t.Run("used up output", func(t *testing.T) {
+		store := NewInMemoryStorage()
+		must(t, store.AddUsage(ctx, "u1", month.start, Usage{OutputBytes: 1000}))
+		var quotaErr *quotaError
+		if _, err := reserveQuota(ctx, Identity{UserId: "u1"}, store, quotas, 1, now); !errors.As(err, &quotaErr) || quotaErr.limit != "output bytes" {
+			t.Errorf("reserveQuota = %v, want the output bytes quota", err)
+		}
+	})
+
+	t.Run("admins are counted but not limited", func(t *testing.T) {
+		store := NewInMemoryStorage()
+		admin := Identity{UserId: "admin", Role: RoleAdmin}
+		for i := range 3 {
+			if _, err := reserveQuota(ctx, admin, store, quotas, 100, now); err != nil {
+				t.Fatalf("task %d: %v", i, err)
+			}
+		}
+		if used := usedToday(t, store, "admin"); used.Tasks != 3 {
+			t.Errorf("usage = %+v, want 3 tasks", used)
+		}
+	})
+
+	t.Run("release", func(t *testing.T) {
+		store := NewInMemoryStorage()
+		user := Identity{UserId: "u1"}
+		release, err := reserveQuota(ctx, user, store, quotas, 10, now)
+		must(t, err)
+		release()
+		if used := usedToday(t, store, "u1"); used != (Usage{}) {
+			t.Errorf("usage after release = %+v, want none", used)
+		}
+	})
+}
+
+func TestReserveQuotaConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	now := time.Now()
+	quotas := Quotas{Daily: Quota{Tasks: 5}}
+	user := Identity{UserId: "u1"}
+
+	var admitted atomic.Int64
+	parallel(50, func(i int) {
+		if _, err := reserveQuota(ctx, user, store, quotas, 1, now); err == nil {
+			admitted.Add(1)
+		}
+	})
+
+	day, _ := usagePeriods(now)
+	used, err := store.GetUsage(ctx, "u1", day.start, day.end)
+	must(t, err)
+	if admitted.Load() > quotas.Daily.Tasks {
+		t.Errorf("%d of 50 concurrent tasks admitted, want at most %d", admitted.Load(), quotas.Daily.Tasks)
+	}
+	if used.Tasks != admitted.Load() || used.InputBytes != admitted.Load() {
+		t.Errorf("usage = %+v, want exactly the %d admitted tasks", used, admitted.Load())
+	}
+}
+
+// TestSubmitTaskQuota submits images whose results are cached, so that
+// accepted tasks complete without a queue.
+func TestSubmitTaskQuota(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	mustRegister(t, store, "u1", "alice")
+	image := testPNG(t, 8, 8)
+	must(t, store.SetCachedResult(ctx, CachedResult{
+		ContentHash: contentHash("u1", "blur", image), UserId: "u1", Result: "cmVzdWx0", ExpiresAt: time.Now().Add(time.Hour),
+	}))
+	cfg := Config{
+		UploadLimits:   UploadLimits{MaxBytes: 1 << 20},
+		ResultCacheTTL: time.Hour,
+		Quotas:         Quotas{Daily: Quota{Tasks: 2}},
+	}
+	handler := CreateTaskHandler(nil, store, store, store, store, cfg)
+
+	submit := func() *httptest.ResponseRecorder {
+		r := uploadRequest(t, "/task", image)
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, Identity{UserId: "u1"}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := range 2 {
+		if w := submit(); w.Code != http.StatusOK {
+			t.Fatalf("task %d: status %d, want 200: %s", i, w.Code, w.Body)
+		}
+	}
+	w := submit()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("task over quota: status %d, want 429: %s", w.Code, w.Body)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter <= 0 || retryAfter > 24*60*60 {
+		t.Errorf("Retry-After = %q, want the seconds until midnight UTC", w.Header().Get("Retry-After"))
+	}
+
+	day, _ := usagePeriods(time.Now())
+	used, err := store.GetUsage(ctx, "u1", day.start, day.end)
+	must(t, err)
+	if used.Tasks != 2 || used.InputBytes != int64(2*len(image)) {
+		t.Errorf("usage = %+v, want the two accepted tasks", used)
+	}
+	tasks, err := store.GetTasks(ctx)
+	if err != nil || len(tasks) != 2 {
+		t.Errorf("GetTasks = %d tasks, %v, want 2", len(tasks), err)
+	}
+}
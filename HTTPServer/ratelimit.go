@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed by client. Each bucket holds up
+// to burst tokens and refills at limit tokens per period.
+type rateLimiter struct {
+	limit int     // tokens per period, as configured
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns a limiter of limit tokens per period. limit and
+// period must be positive; callers use a nil limiter to disable limiting.
+func newRateLimiter(limit int, period time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		rate:    float64(limit) / period.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key's bucket. When the bucket is empty it
+// reports how long the caller has to wait for the next token. A nil limiter
+// allows everything.
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	decision := l.Take(key, now)
+	return decision.Allowed, decision.RetryAfter
+}
+
+// rateLimitDecision is the outcome of Take.
+type rateLimitDecision struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long to wait for the next token if not allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Take is Allow with the bucket state needed for X-RateLimit-* headers.
+func (l *rateLimiter) Take(key string, now time.Time) rateLimitDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key, now)
+	var decision rateLimitDecision
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = l.wait(1 - b.tokens)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = l.wait(l.burst - b.tokens)
+	return decision
+}
+
+func (l *rateLimiter) refill(key string, now time.Time) *bucket {
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+func (l *rateLimiter) wait(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.rate * float64(time.Second)))
+}
+
+// Prune forgets buckets that have refilled completely, since they behave
+// exactly like new ones.
+func (l *rateLimiter) Prune(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitTasks limits task submissions per user, so that one client cannot
+// flood the queue. Requests made with any of the user's API keys share the
+// user's bucket; otherwise creating more keys would raise the limit. A nil
+// limiter lets every request through.
+func rateLimitTasks(limiter *rateLimiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			decision := limiter.Take("user:"+identityFromContext(r.Context()).UserId, time.Now())
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limiter.limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.Reset.Seconds()))))
+			if !decision.Allowed {
+				setRetryAfter(w, decision.RetryAfter)
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many tasks")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	type step struct {
+		at         time.Duration // since the first request
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit int
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst then empty",
+			limit: 60, burst: 3, // one token per second
+			steps: []step{
+				{at: 0, allowed: true, remaining: 2, reset: time.Second},
+				{at: 0, allowed: true, remaining: 1, reset: 2 * time.Second},
+				{at: 0, allowed: true, remaining: 0, reset: 3 * time.Second},
+				{at: 0, allowed: false, remaining: 0, retryAfter: time.Second, reset: 3 * time.Second},
+			},
+		},
+		{
+			name:  "partial refill",
+			limit: 60, burst: 1,
+			steps: []step{
+				{at: 0, allowed: true, remaining: 0, reset: time.Second},
+				{at: 400 * time.Millisecond, allowed: false, remaining: 0, retryAfter: 600 * time.Millisecond, reset: 600 * time.Millisecond},
+				{at: time.Second, allowed: true, remaining: 0, reset: time.Second},
+			},
+		},
+		{
+			name:  "refill stops at burst",
+			limit: 60, burst: 2,
+			steps: []step{
+				{at: 0, allowed: true, remaining: 1, reset: time.Second},
+				{at: time.Hour, allowed: true, remaining: 1, reset: time.Second},
+				{at: time.Hour, allowed: true, remaining: 0, reset: 2 * time.Second},
+				{at: time.Hour, allowed: false, remaining: 0, retryAfter: time.Second, reset: 2 * time.Second},
+			},
+		},
+		{
+			name:  "slow rate",
+			limit: 10, burst: 1, // one token per six seconds
+			steps: []step{
+				{at: 0, allowed: true, remaining: 0, reset: 6 * time.Second},
+				{at: 0, allowed: false, remaining: 0, retryAfter: 6 * time.Second, reset: 6 * time.Second},
+				{at: 3 * time.Second, allowed: false, remaining: 0, retryAfter: 3 * time.Second, reset: 3 * time.Second},
+				{at: 6 * time.Second, allowed: true, remaining: 0, reset: 6 * time.Second},
+			},
+		},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.limit, time.Minute, tt.burst)
+			for i, s := range tt.steps {
+				d := limiter.Take("k", start.Add(s.at))
+				want := rateLimitDecision{Allowed: s.allowed, Remaining: s.remaining, RetryAfter: s.retryAfter, Reset: s.reset}
+				if d != want {
+					t.Errorf("step %d: Take = %+v, want %+v", i, d, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterKeysAreIndependent(t *testing.T) {
+	limiter := newRateLimiter(60, time.Minute, 1)
+	now := time.Now()
+	if ok, _ := limiter.Allow("a", now); !ok {
+		t.Fatal("first request of a was refused")
+	}
+	if ok, _ := limiter.Allow("b", now); !ok {
+		t.Error("b was limited by a's bucket")
+	}
+	if ok, _ := limiter.Allow("a", now); ok {
+		t.Error("a was allowed past its burst")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter := newRateLimiter(60, time.Minute, 2)
+	now := time.Now()
+	limiter.Allow("full", now)
+	limiter.Allow("drained", now)
+	limiter.Allow("drained", now)
+
+	limiter.Prune(now.Add(time.Second))
+	if _, ok := limiter.buckets["full"]; ok {
+		t.Error("refilled bucket was kept")
+	}
+	if _, ok := limiter.buckets["drained"]; !ok {
+		t.Error("bucket that is still refilling was pruned")
+	}
+
+	// A pruned bucket starts full again, just as if it had been kept.
+	if d := limiter.Take("full", now.Add(time.Second)); !d.Allowed || d.Remaining != 1 {
+		t.Errorf("Take after prune = %+v, want a full bucket", d)
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var limiter *rateLimiter
+	if ok, _ := limiter.Allow("k", time.Now()); !ok {
+		t.Error("nil limiter refused a request")
+	}
+	limiter.Prune(time.Now())
+}
+
+func TestRateLimitTasks(t *testing.T) {
+	handler := rateLimitTasks(newRateLimiter(60, time.Minute, 2))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(identity Identity) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/task", nil)
+		r = r.WithContext(context.WithValue(r.Context(), identityContextKey, identity))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Every API key of a user draws from the user's bucket.
+	tests := []struct {
+		identity  Identity
+		code      int
+		remaining string
+	}{
+		{Identity{UserId: "u1", APIKeyId: "k1"}, http.StatusOK, "1"},
+		{Identity{UserId: "u1", APIKeyId: "k2"}, http.StatusOK, "0"},
+		{Identity{UserId: "u1", SessionId: "s1"}, http.StatusTooManyRequests, "0"},
+		{Identity{UserId: "u1", APIKeyId: "k3"}, http.StatusTooManyRequests, "0"},
+		{Identity{UserId: "u2", APIKeyId: "k4"}, http.StatusOK, "1"},
+	}
+	for i, tt := range tests {
+		w := request(tt.identity)
+		if w.Code != tt.code {
+			t.Errorf("request %d: status %d, want %d", i, w.Code, tt.code)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "60" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want the configured 60", i, got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i, got, tt.remaining)
+		}
+		if tt.code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("request %d: Retry-After = %q, want 1", i, w.Header().Get("Retry-After"))
+		}
+	}
+}
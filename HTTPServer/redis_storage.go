@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStorage keeps server-side sessions and tasks in Redis so that several
+// replicas of the HTTP service share them, and delegates everything else
+// (the UserStore, refresh tokens, usage, idempotency keys and the result
+// cache) to the embedded Storage. Sessions expire through Redis TTLs; tasks
+// expire taskTTL after they were last written or, if later, after their
+// result expires.
+//
+// Keys:
+//
+//	session:<id>          JSON Session
+//	user_sessions:<user>  set of the user's session IDs
+//	task:<id>             JSON Task
+//	user_tasks:<user>     set of the user's task IDs
+//	task_expiry           sorted set of ready task IDs by result expiry, in Unix ms
+type RedisStorage struct {
+	Storage
+	client  *redis.Client
+	taskTTL time.Duration
+}
+
+// NewRedisStorage connects to the Redis server at url, e.g.
+// redis://localhost:6379/0. A taskTTL of zero keeps tasks forever.
+func NewRedisStorage(ctx context.Context, url string, base Storage, taskTTL time.Duration) (*RedisStorage, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return &RedisStorage{Storage: base, client: client, taskTTL: taskTTL}, nil
+}
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
+
+// Ping checks both Redis and the embedded storage.
+func (s *RedisStorage) Ping(ctx context.Context) error {
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return redisError("ping", err)
+	}
+	return s.Storage.Ping(ctx)
+}
+
+// redisError maps redis.Nil to ErrNotFound and wraps everything else with
+// the operation that failed.
+func redisError(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, redis.Nil):
+		return ErrNotFound
+	default:
+		return &StorageError{Op: "redis " + op, Err: err}
+	}
+}
+
+func sessionKey(id string) string      { return "session:" + id }
+func userSessionsKey(id string) string { return "user_sessions:" + id }
+func taskKey(id string) string         { return "task:" + id }
+func userTasksKey(id string) string    { return "user_tasks:" + id }
+
+const taskExpiryKey = "task_expiry"
+
+// redisGet decodes the JSON value stored under key. It returns redis.Nil if
+// there is none.
+func redisGet[T any](ctx context.Context, client redis.Cmdable, key string) (T, error) {
+	var value T
+	data, err := client.Get(ctx, key).Bytes()
+	if err != nil {
+		return value, err
+	}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// redisGetAll decodes the JSON values stored under keys, skipping keys that
+// no longer exist. missing lists the skipped keys.
+func redisGetAll[T any](ctx context.Context, client redis.Cmdable, keys []string) (values []T, missing []string, err error) {
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	results, err := client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, result := range results {
+		data, ok := result.(string)
+		if !ok {
+			missing = append(missing, keys[i])
+			continue
+		}
+		var value T
+		if err := json.Unmarshal([]byte(data), &value); err != nil {
+			return nil, nil, err
+		}
+		values = append(values, value)
+	}
+	return values, missing, nil
+}
+
+func (s *RedisStorage) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// sessionTTL returns how long the session has left, or zero if it never
+// expires. The session must not be expired yet.
+func sessionTTL(session Session, now time.Time) time.Duration {
+	deadline := session.ExpiresAt
+	if session.IdleTimeout > 0 {
+		idle := session.LastSeenAt.Add(session.IdleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	if deadline.IsZero() {
+		return 0
+	}
+	// Redis rejects expiries below a millisecond.
+	return max(deadline.Sub(now), time.Millisecond)
+}
+
+// setSession writes the session with a TTL matching its remaining lifetime,
+// or removes it if it has already expired.
+func setSession(ctx context.Context, pipe redis.Pipeliner, session Session, now time.Time) error {
+	if session.Expired(now) {
+		pipe.Del(ctx, sessionKey(session.SessionId))
+		pipe.SRem(ctx, userSessionsKey(session.UserId), session.SessionId)
+		return nil
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, sessionKey(session.SessionId), data, sessionTTL(session, now))
+	pipe.SAdd(ctx, userSessionsKey(session.UserId), session.SessionId)
+	return nil
+}
+
+func (s *RedisStorage) SetSession(ctx context.Context, session Session) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return setSession(ctx, pipe, session, time.Now())
+	})
+	return redisError("set session", err)
+}
+
+func (s *RedisStorage) GetSession(ctx context.Context, SessionId string) (Session, error) {
+	session, err := redisGet[Session](ctx, s.client, sessionKey(SessionId))
+	if err != nil {
+		return Session{}, redisError("get session", err)
+	}
+	// The TTL is only as precise as Redis' expiry, so check again.
+	if session.Expired(time.Now()) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+// TouchSession extends the session's idle deadline. WATCH makes sure a
+// session deleted in the meantime is not written back; losing the race to
+// another touch is harmless.
+func (s *RedisStorage) TouchSession(ctx context.Context, SessionId string, now time.Time) error {
+	key := sessionKey(SessionId)
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		session, err := redisGet[Session](ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		session.LastSeenAt = now
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return setSession(ctx, pipe, session, now)
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil
+	}
+	return redisError("touch session", err)
+}
+
+func (s *RedisStorage) DeleteSession(ctx context.Context, SessionId string) error {
+	key := sessionKey(SessionId)
+	session, err := redisGet[Session](ctx, s.client, key)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return redisError("delete session", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, userSessionsKey(session.UserId), SessionId)
+		return nil
+	})
+	return redisError("delete session", err)
+}
+
+func (s *RedisStorage) GetUserSessions(ctx context.Context, UserId string) ([]Session, error) {
+	ids, err := s.client.SMembers(ctx, userSessionsKey(UserId)).Result()
+	if err != nil {
+		return nil, redisError("list user sessions", err)
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionKey(id)
+	}
+	found, missing, err := redisGetAll[Session](ctx, s.client, keys)
+	if err != nil {
+		return nil, redisError("list user sessions", err)
+	}
+	// Sessions expired by Redis leave their IDs behind in the index.
+	for _, key := range missing {
+		s.client.SRem(ctx, userSessionsKey(UserId), strings.TrimPrefix(key, sessionKey("")))
+	}
+	now := time.Now()
+	var sessions []Session
+	for _, session := range found {
+		if !session.Expired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *RedisStorage) DeleteUserSessions(ctx context.Context, UserId string, keepSessionId string) error {
+	ids, err := s.client.SMembers(ctx, userSessionsKey(UserId)).Result()
+	if err != nil {
+		return redisError("delete user sessions", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			if id != keepSessionId {
+				pipe.Del(ctx, sessionKey(id))
+				pipe.SRem(ctx, userSessionsKey(UserId), id)
+			}
+		}
+		return nil
+	})
+	return redisError("delete user sessions", err)
+}
+
+// DeleteExpiredSessions drops index entries of sessions that Redis has
+// already expired. The sessions themselves need no garbage collection, so
+// the count covers only those that outlived their TTL by a few
+// milliseconds.
+func (s *RedisStorage) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	indexes, err := s.scanKeys(ctx, userSessionsKey("*"))
+	if err != nil {
+		return 0, redisError("delete expired sessions", err)
+	}
+	removed := 0
+	for _, index := range indexes {
+		ids, err := s.client.SMembers(ctx, index).Result()
+		if err != nil {
+			return removed, redisError("delete expired sessions", err)
+		}
+		for _, id := range ids {
+			session, err := redisGet[Session](ctx, s.client, sessionKey(id))
+			if err == nil && !session.Expired(now) {
+				continue
+			}
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return removed, redisError("delete expired sessions", err)
+			}
+			if err == nil {
+				if err := s.client.Del(ctx, sessionKey(id)).Err(); err != nil {
+					return removed, redisError("delete expired sessions", err)
+				}
+				removed++
+			}
+			if err := s.client.SRem(ctx, index, id).Err(); err != nil {
+				return removed, redisError("delete expired sessions", err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// taskKeyTTL returns the TTL of the task's key: taskTTL after the later of
+// now and the expiry of the task's result, so that no result is dropped
+// before its retention ends and an expired task is still reported as such
+// for taskTTL. Results kept forever keep their task forever.
+func (s *RedisStorage) taskKeyTTL(task Task, now time.Time) time.Duration {
+	if s.taskTTL == 0 || (task.Status == "ready" && task.ExpiresAt.IsZero()) {
+		return 0
+	}
+	return max(task.ExpiresAt.Sub(now), 0) + s.taskTTL
+}
+
+func (s *RedisStorage) SetTask(ctx context.Context, task Task) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, taskKey(task.Id), data, s.taskKeyTTL(task, time.Now()))
+		if task.Status == "ready" && !task.ExpiresAt.IsZero() {
+			pipe.ZAdd(ctx, taskExpiryKey, redis.Z{Score: float64(task.ExpiresAt.UnixMilli()), Member: task.Id})
+		} else {
+			pipe.ZRem(ctx, taskExpiryKey, task.Id)
+		}
+		if task.UserId != "" {
+			pipe.SAdd(ctx, userTasksKey(task.UserId), task.Id)
+		}
+		return nil
+	})
+	return redisError("set task", err)
+}
+
+func (s *RedisStorage) GetTask(ctx context.Context, id string) (Task, error) {
+	task, err := redisGet[Task](ctx, s.client, taskKey(id))
+	return task, redisError("get task", err)
+}
+
+func (s *RedisStorage) GetTasks(ctx context.Context) ([]Task, error) {
+	keys, err := s.scanKeys(ctx, taskKey("*"))
+	if err != nil {
+		return nil, redisError("list tasks", err)
+	}
+	tasks, _, err := redisGetAll[Task](ctx, s.client, keys)
+	return tasks, redisError("list tasks", err)
+}
+
+func (s *RedisStorage) DeleteTasks(ctx context.Context, status string, createdBefore time.Time) (int, error) {
+	tasks, err := s.GetTasks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, task := range tasks {
+		if (status == "" || task.Status == status) && task.CreatedAt.Before(createdBefore) {
+			_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, taskKey(task.Id))
+				pipe.ZRem(ctx, taskExpiryKey, task.Id)
+				if task.UserId != "" {
+					pipe.SRem(ctx, userTasksKey(task.UserId), task.Id)
+				}
+				return nil
+			})
+			if err != nil {
+				return removed, redisError("delete tasks", err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// DeleteExpiredResults rewrites expired tasks without their results and
+// deletes expired derived image tasks, reading only the tasks that
+// task_expiry lists as due. Each write keeps the task's TTL, so an expired
+// task is still dropped taskTTL after its result expired. It then prunes
+// the users' task indexes of the tasks Redis has dropped.
+func (s *RedisStorage) DeleteExpiredResults(ctx context.Context, now time.Time) (int, error) {
+	ids, err := s.client.ZRangeByScore(ctx, taskExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return 0, redisError("delete expired results", err)
+	}
+	removed := 0
+	for _, id := range ids {
+		task, err := redisGet[Task](ctx, s.client, taskKey(id))
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return removed, redisError("delete expired results", err)
+		}
+		// Entries of tasks that are gone or were rewritten are dropped.
+		if err != nil || task.Status != "ready" || task.ExpiresAt.IsZero() {
+			if err := s.client.ZRem(ctx, taskExpiryKey, id).Err(); err != nil {
+				return removed, redisError("delete expired results", err)
+			}
+			continue
+		}
+		// Scores are in milliseconds; the rest of the millisecond is due
+		// next time.
+		if !task.ResultExpired(now) {
+			continue
+		}
+		var data []byte
+		if task.SourceId == "" {
+			if data, err = json.Marshal(task.expire()); err != nil {
+				return removed, err
+			}
+		}
+		_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if task.SourceId != "" {
+				pipe.Del(ctx, taskKey(task.Id))
+				pipe.SRem(ctx, userTasksKey(task.UserId), task.Id)
+			} else {
+				pipe.SetArgs(ctx, taskKey(task.Id), data, redis.SetArgs{Mode: "XX", KeepTTL: true})
+			}
+			pipe.ZRem(ctx, taskExpiryKey, task.Id)
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return removed, redisError("delete expired results", err)
+		}
+		removed++
+	}
+	return removed, s.pruneUserTasks(ctx)
+}
+
+// pruneUserTasks drops index entries of tasks whose keys Redis has
+// expired. The tasks are not counted as removed: they are already gone.
+func (s *RedisStorage) pruneUserTasks(ctx context.Context) error {
+	indexes, err := s.scanKeys(ctx, userTasksKey("*"))
+	if err != nil {
+		return redisError("prune user tasks", err)
+	}
+	for _, index := range indexes {
+		ids, err := s.client.SMembers(ctx, index).Result()
+		if err != nil {
+			return redisError("prune user tasks", err)
+		}
+		for _, id := range ids {
+			exists, err := s.client.Exists(ctx, taskKey(id)).Result()
+			if err != nil {
+				return redisError("prune user tasks", err)
+			}
+			if exists != 0 {
+				continue
+			}
+			if err := s.client.SRem(ctx, index, id).Err(); err != nil {
+				return redisError("prune user tasks", err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteUser removes the user from the embedded storage and then their
+// sessions and tasks from Redis.
+func (s *RedisStorage) DeleteUser(ctx context.Context, id string) error {
+	if err := s.Storage.DeleteUser(ctx, id); err != nil {
+		return err
+	}
+	sessionIds, err := s.client.SMembers(ctx, userSessionsKey(id)).Result()
+	if err != nil {
+		return redisError("delete user", err)
+	}
+	taskIds, err := s.client.SMembers(ctx, userTasksKey(id)).Result()
+	if err != nil {
+		return redisError("delete user", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, sessionId := range sessionIds {
+			pipe.Del(ctx, sessionKey(sessionId))
+		}
+		for _, taskId := range taskIds {
+			pipe.Del(ctx, taskKey(taskId))
+			pipe.ZRem(ctx, taskExpiryKey, taskId)
+		}
+		pipe.Del(ctx, userSessionsKey(id), userTasksKey(id))
+		return nil
+	})
+	return redisError("delete user", err)
+}
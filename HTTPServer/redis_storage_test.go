@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisStorage(t *testing.T, taskTTL time.Duration) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	store, err := NewRedisStorage(context.Background(), "redis://"+server.Addr(), NewInMemoryStorage(), taskTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestRedisStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		store, _ := newTestRedisStorage(t, time.Hour)
+		return store
+	})
+}
+
+func TestRedisStorageTTL(t *testing.T) {
+	store, server := newTestRedisStorage(t, time.Hour)
+	mustRegister(t, store, "u1", "alice")
+	now := time.Now()
+
+	ctx := context.Background()
+	must(t, store.SetSession(ctx, Session{UserId: "u1", SessionId: "s1", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour), IdleTimeout: 10 * time.Minute}))
+	must(t, store.SetTask(ctx, Task{Id: "t1", UserId: "u1", CreatedAt: now, Status: "in_progress"}))
+	// Retention longer than taskTTL extends the key's TTL.
+	must(t, store.SetTask(ctx, Task{Id: "t2", UserId: "u1", CreatedAt: now, Status: "ready", ResultTTL: 3 * time.Hour, CompletedAt: now, ExpiresAt: now.Add(3 * time.Hour)}))
+	must(t, store.SetTask(ctx, Task{Id: "forever", UserId: "u1", CreatedAt: now, Status: "ready", CompletedAt: now}))
+
+	if ttl := server.TTL(sessionKey("s1")); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("session TTL = %v, want the idle timeout", ttl)
+	}
+	if ttl := server.TTL(taskKey("t1")); ttl != time.Hour {
+		t.Errorf("task TTL = %v, want %v", ttl, time.Hour)
+	}
+	if ttl := server.TTL(taskKey("t2")); ttl <= 3*time.Hour+59*time.Minute || ttl > 4*time.Hour {
+		t.Errorf("TTL of a task kept for 3h = %v, want the retention plus %v", ttl, time.Hour)
+	}
+	if ttl := server.TTL(taskKey("forever")); ttl != 0 {
+		t.Errorf("TTL of a task kept forever = %v, want none", ttl)
+	}
+
+	server.FastForward(11 * time.Minute)
+	_, err := store.GetSession(ctx, "s1")
+	mustBeMissing(t, err, "session after its idle timeout")
+	if sessions, _ := store.GetUserSessions(ctx, "u1"); len(sessions) != 0 {
+		t.Errorf("GetUserSessions returned %d expired sessions", len(sessions))
+	}
+	if server.Exists(userSessionsKey("u1")) {
+		t.Error("expired session was not removed from the user's index")
+	}
+
+	server.FastForward(time.Hour)
+	_, err = store.GetTask(ctx, "t1")
+	mustBeMissing(t, err, "task after its TTL")
+	if task, err := store.GetTask(ctx, "t2"); err != nil || task.Status != "ready" {
+		t.Errorf("task was dropped before its result expired: %+v, %v", task, err)
+	}
+
+	// The expired task outlives its result by taskTTL.
+	server.FastForward(2 * time.Hour)
+	if _, err := store.GetTask(ctx, "t2"); err != nil {
+		t.Errorf("task right after its result expired: %v", err)
+	}
+	server.FastForward(time.Hour)
+	_, err = store.GetTask(ctx, "t2")
+	mustBeMissing(t, err, "task taskTTL after its result expired")
+	if _, err := store.GetTask(ctx, "forever"); err != nil {
+		t.Errorf("task kept forever was dropped: %v", err)
+	}
+}
+
+func TestRedisStoragePrunesUserTasks(t *testing.T) {
+	store, server := newTestRedisStorage(t, time.Hour)
+	mustRegister(t, store, "u1", "alice")
+	ctx := context.Background()
+	now := time.Now()
+	must(t, store.SetTask(ctx, Task{Id: "t1", UserId: "u1", CreatedAt: now, Status: "in_progress"}))
+	must(t, store.SetTask(ctx, Task{Id: "t2", UserId: "u1", CreatedAt: now, Status: "ready", CompletedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	// Nothing is pruned while the tasks are there.
+	if _, err := store.DeleteExpiredResults(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := server.SMembers(userTasksKey("u1")); len(ids) != 2 {
+		t.Errorf("user's task index = %v, want t1 and t2", ids)
+	}
+
+	server.FastForward(2*time.Hour + time.Minute)
+	if _, err := store.DeleteExpiredResults(ctx, now.Add(2*time.Hour+time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(userTasksKey("u1")) {
+		ids, _ := server.SMembers(userTasksKey("u1"))
+		t.Errorf("user's task index after the tasks expired = %v, want it emptied", ids)
+	}
+}
+
+// TestRedisStorageTaskExpiryIndex checks that task_expiry holds exactly the
+// ready tasks with an expiry.
+func TestRedisStorageTaskExpiryIndex(t *testing.T) {
+	store, server := newTestRedisStorage(t, time.Hour)
+	mustRegister(t, store, "u1", "alice")
+	ctx := context.Background()
+	now := time.Now()
+	must(t, store.SetTask(ctx, Task{Id: "pending", UserId: "u1", Status: "in_progress", ResultTTL: time.Hour}))
+	must(t, store.SetTask(ctx, Task{Id: "forever", UserId: "u1", Status: "ready"}))
+	must(t, store.SetTask(ctx, Task{Id: "t1", UserId: "u1", Status: "ready", ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetTask(ctx, Task{Id: "t2", UserId: "u1", Status: "ready", ExpiresAt: now.Add(2 * time.Hour)}))
+
+	members := func() []string {
+		t.Helper()
+		if !server.Exists(taskExpiryKey) {
+			return nil
+		}
+		members, err := server.ZMembers(taskExpiryKey)
+		must(t, err)
+		return members
+	}
+	if got := members(); len(got) != 2 {
+		t.Errorf("task_expiry = %v, want t1 and t2", got)
+	}
+
+	if removed, err := store.DeleteExpiredResults(ctx, now.Add(time.Hour)); err != nil || removed != 1 {
+		t.Errorf("DeleteExpiredResults = %d, %v, want 1", removed, err)
+	}
+	if got := members(); len(got) != 1 || got[0] != "t2" {
+		t.Errorf("task_expiry after expiry = %v, want t2", got)
+	}
+
+	must(t, store.DeleteUser(ctx, "u1"))
+	if got := members(); len(got) != 0 {
+		t.Errorf("task_expiry after DeleteUser = %v, want none", got)
+	}
+}
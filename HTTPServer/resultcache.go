@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// normalizePipeline brings equivalent spellings of a filter pipeline, such
+// as " Blur" and "blur", to one form.
+func normalizePipeline(pipeline string) string {
+	steps := strings.Split(strings.ToLower(pipeline), ",")
+	for i, step := range steps {
+		steps[i] = strings.TrimSpace(step)
+	}
+	return strings.Join(steps, ",")
+}
+
+// contentHash identifies the result of applying a normalized pipeline to an
+// image within scope: the ID of the uploading user, so that users only get
+// their own cached results, or "" for a cache shared by all users.
+func contentHash(scope string, pipeline string, image []byte) string {
+	h := sha256.New()
+	if scope != "" {
+		h.Write([]byte(scope))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(pipeline))
+	h.Write([]byte{0})
+	h.Write(image)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedResult returns the cached result for the hash, if there is one that
+// has not expired.
+func cachedResult(ctx context.Context, cache ResultCacheStore, hash string, now time.Time) (CachedResult, bool, error) {
+	entry, err := cache.GetCachedResult(ctx, hash, now)
+	if errors.Is(err, ErrNotFound) {
+		return CachedResult{}, false, nil
+	}
+	if err != nil {
+		return CachedResult{}, false, err
+	}
+	return entry, true, nil
+}
+
+// resultCacheScope returns the contentHash scope of the user's uploads.
+func resultCacheScope(cfg Config, userID string) string {
+	if cfg.ResultCacheShared {
+		return ""
+	}
+	return userID
+}
+
+// cacheResult stores the result of a completed task for ttl, so that the
+// same input and pipeline are not processed again in the meantime. The
+// entry belongs to the task's owner and never outlives the retention the
+// owner chose for the task.
+func cacheResult(ctx context.Context, cache ResultCacheStore, task Task, ttl time.Duration, now time.Time) error {
+	expiresAt := now.Add(ttl)
+	if !task.ExpiresAt.IsZero() && task.ExpiresAt.Before(expiresAt) {
+		expiresAt = task.ExpiresAt
+	}
+	return cache.SetCachedResult(ctx, CachedResult{
+		ContentHash: task.ContentHash,
+		UserId:      task.UserId,
+		Result:      task.Result,
+		ExpiresAt:   expiresAt,
+	})
+}
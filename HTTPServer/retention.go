@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ResultRetention decides how long task results are kept after the task
+// completes. Clients may ask for a different retention up to Max.
+type ResultRetention struct {
+	Default time.Duration
+	Max     time.Duration
+}
+
+// TTL returns the retention for a task. requested is a duration such as
+// "2h" from the client, or empty for the default.
+func (p ResultRetention) TTL(requested string) (time.Duration, error) {
+	if requested == "" {
+		return p.Default, nil
+	}
+	ttl, err := time.ParseDuration(requested)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("retention must be a positive duration such as 1h30m")
+	}
+	if p.Max > 0 && ttl > p.Max {
+		return 0, fmt.Errorf("retention must not exceed %s", p.Max)
+	}
+	return ttl, nil
+}
+
+// completeTask records that the worker finished the task, takes the ETag
+// of its result and starts the retention clock of the result.
+func completeTask(task Task, now time.Time) Task {
+	task.CompletedAt = now
+	task.ResultETag = resultETag(task.Result)
+	if task.ResultTTL > 0 {
+		task.ExpiresAt = now.Add(task.ResultTTL)
+	}
+	return task
+}
@@ -1,97 +1,824 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Task struct {
-	Status string
-	Result string
+	Id         string
+	UserId     string
+	FilterName string
+	CreatedAt  time.Time
+	Status     string
+	Result     string
+	// ResultTTL is how long the result is kept after the task completes;
+	// zero keeps it forever.
+	ResultTTL   time.Duration
+	CompletedAt time.Time
+	// ExpiresAt is when the result is deleted. It is set on completion.
+	ExpiresAt time.Time
+	// ContentHash identifies the input image, pipeline and, unless the
+	// cache is shared, owner for the result cache; see contentHash.
+	ContentHash string
+	// ResultETag is the ETag of the result, set on completion so that
+	// revalidating it does not need the result decoded.
+	ResultETag string
+	// SourceId is the task whose result a derived image task processes.
+	// Derived image tasks are deleted, not kept, once their result expires.
+	SourceId string
+}
+
+// ResultExpired reports whether the task's result has outlived its
+// retention, whether or not the janitor has deleted it yet.
+func (t Task) ResultExpired(now time.Time) bool {
+	return t.Status == "expired" || (!t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt))
 }
 
 type Session struct {
+	UserId      string
+	SessionId   string
+	CreatedAt   time.Time
+	LastSeenAt  time.Time
+	ExpiresAt   time.Time
+	IdleTimeout time.Duration
+	UserAgent   string
+	RemoteAddr  string
+}
+
+// Expired reports whether the session has outlived its absolute lifetime
+// or has not been used for longer than its idle timeout.
+func (s Session) Expired(now time.Time) bool {
+	if !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt) {
+		return true
+	}
+	return s.IdleTimeout > 0 && now.Sub(s.LastSeenAt) >= s.IdleTimeout
+}
+
+// RefreshToken is the persisted half of a JWT login. Its ID is the session
+// ID of the access tokens minted from it; only a hash of the current secret
+// is kept.
+type RefreshToken struct {
+	Id         string
+	UserId     string
+	Hash       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	RemoteAddr string
+}
+
+func (t RefreshToken) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+type APIKey struct {
+	Id     string
+	UserId string
+	Name   string
+	// Prefix is the non-secret beginning of the key, shown to help users
+	// tell their keys apart.
+	Prefix     string
+	Hash       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+}
+
+// Expired reports whether the key has an expiry date that has passed.
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// Usage is what a user consumed over some period.
+type Usage struct {
+	Tasks       int64
+	InputBytes  int64
+	OutputBytes int64
+	// CPUTime is the processing time reported by the worker.
+	CPUTime time.Duration
+}
+
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		Tasks:       u.Tasks + other.Tasks,
+		InputBytes:  u.InputBytes + other.InputBytes,
+		OutputBytes: u.OutputBytes + other.OutputBytes,
+		CPUTime:     u.CPUTime + other.CPUTime,
+	}
+}
+
+// usageDay returns the start of the UTC day usage at t is accounted to.
+func usageDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// usageDays returns the days GetUsage sums: from the day of from up to the
+// day of to, which is included if to is past its midnight.
+func usageDays(from time.Time, to time.Time) (first time.Time, end time.Time) {
+	first, end = usageDay(from), usageDay(to)
+	if end.Before(to) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return first, end
+}
+
+// IdempotencyKey ties an Idempotency-Key sent by a user to the task the
+// request created.
+type IdempotencyKey struct {
+	UserId string
+	Key    string
+	TaskId string
+	// Fingerprint identifies the request, so that reusing a key for a
+	// different request can be told apart from a retry.
+	Fingerprint string
+	ExpiresAt   time.Time
+}
+
+func (k IdempotencyKey) Expired(now time.Time) bool {
+	return !now.Before(k.ExpiresAt)
+}
+
+// CachedResult is a result kept for reuse by identical uploads, keyed by
+// their Task.ContentHash.
+type CachedResult struct {
+	ContentHash string
+	// UserId is the owner of the task that produced the result. The entry
+	// is deleted together with them.
 	UserId    string
-	SessionId string
+	Result    string
+	ExpiresAt time.Time
+}
+
+func (c CachedResult) Expired(now time.Time) bool {
+	return !now.Before(c.ExpiresAt)
 }
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	id    string
-	login string
-	hash  string
+	id        string
+	login     string
+	hash      string
+	role      string
+	disabled  bool
+	createdAt time.Time
+}
+
+var (
+	// ErrNotFound is returned for records that do not exist, have expired or,
+	// for updates, no longer match the expected state.
+	ErrNotFound   = errors.New("not found")
+	ErrUserExists = errors.New("user already exists")
+)
+
+// StorageError reports a failure of the storage backend itself, such as a
+// lost connection, as opposed to a missing or conflicting record.
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// UserStore keeps accounts and the API keys that belong to them.
+type UserStore interface {
+	RegisterUser(ctx context.Context, id string, username string, password string) error
+	GetUserByLogin(ctx context.Context, login string) (User, error)
+	GetUserById(ctx context.Context, id string) (User, error)
+	GetUsers(ctx context.Context) ([]User, error)
+	SetUserRole(ctx context.Context, id string, role string) error
+	SetUserDisabled(ctx context.Context, id string, disabled bool) error
+	SetUserPassword(ctx context.Context, id string, password string) error
+	SetAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	GetUserAPIKeys(ctx context.Context, UserId string) ([]APIKey, error)
+	TouchAPIKey(ctx context.Context, id string, now time.Time) error
+	// DeleteAPIKey removes the key if it belongs to the user.
+	DeleteAPIKey(ctx context.Context, UserId string, id string) error
+}
+
+// SessionStore keeps login sessions: server-side sessions and the refresh
+// tokens of JWT logins. GetSession and the per-user listings leave out
+// expired records.
+type SessionStore interface {
+	SetSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, SessionId string) (Session, error)
+	TouchSession(ctx context.Context, SessionId string, now time.Time) error
+	DeleteSession(ctx context.Context, SessionId string) error
+	GetUserSessions(ctx context.Context, UserId string) ([]Session, error)
+	// DeleteUserSessions revokes every session of the user except
+	// keepSessionId, which may be empty to revoke all of them.
+	DeleteUserSessions(ctx context.Context, UserId string, keepSessionId string) error
+	// DeleteExpiredSessions garbage-collects expired sessions and returns
+	// how many were removed.
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error)
+	SetRefreshToken(ctx context.Context, token RefreshToken) error
+	GetRefreshToken(ctx context.Context, id string) (RefreshToken, error)
+	// RotateRefreshToken replaces the token's hash if it still equals
+	// oldHash, so that two concurrent refreshes with the same token cannot
+	// both succeed. It returns ErrNotFound if the hash did not match.
+	RotateRefreshToken(ctx context.Context, id string, oldHash string, newHash string, now time.Time) error
+	DeleteRefreshToken(ctx context.Context, id string) error
+	GetUserRefreshTokens(ctx context.Context, UserId string) ([]RefreshToken, error)
+	DeleteUserRefreshTokens(ctx context.Context, UserId string, keepId string) error
+	DeleteExpiredRefreshTokens(ctx context.Context, now time.Time) (int, error)
+}
+
+// TaskStore keeps image processing tasks and their results.
+type TaskStore interface {
+	SetTask(ctx context.Context, task Task) error
+	GetTask(ctx context.Context, id string) (Task, error)
+	GetTasks(ctx context.Context) ([]Task, error)
+	// DeleteTasks removes tasks created before createdBefore, optionally
+	// only those with the given status, and returns how many were removed.
+	DeleteTasks(ctx context.Context, status string, createdBefore time.Time) (int, error)
+	// DeleteExpiredResults drops the results of ready tasks whose ExpiresAt
+	// has passed and marks them "expired", keeping the tasks themselves so
+	// that clients can tell an expired result from an unknown task. Derived
+	// image tasks, which no client polls, are deleted instead. It returns
+	// how many results were removed.
+	DeleteExpiredResults(ctx context.Context, now time.Time) (int, error)
+}
+
+// UsageStore accounts what users consume, per user and UTC day.
+type UsageStore interface {
+	// AddUsage adds delta to the user's usage on the day of at.
+	AddUsage(ctx context.Context, UserId string, at time.Time, delta Usage) error
+	// GetUsage sums the user's usage on the days from from up to, but not
+	// including, to. Days are counted whole; see usageDays.
+	GetUsage(ctx context.Context, UserId string, from time.Time, to time.Time) (Usage, error)
+}
+
+// IdempotencyStore remembers which task each idempotency key created.
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores key unless the user already holds an
+	// unexpired key with the same Key, and returns the one in effect: key
+	// itself if it was stored, the existing one otherwise.
+	ClaimIdempotencyKey(ctx context.Context, key IdempotencyKey, now time.Time) (IdempotencyKey, error)
+	// DeleteIdempotencyKey releases a key, e.g. when the request that
+	// claimed it failed. Missing keys are not an error.
+	DeleteIdempotencyKey(ctx context.Context, UserId string, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error)
+}
+
+// ResultCacheStore keeps the result cache. Entries live apart from tasks:
+// they are not listed with them and are deleted outright once expired.
+type ResultCacheStore interface {
+	// SetCachedResult stores entry, replacing any entry for its hash.
+	SetCachedResult(ctx context.Context, entry CachedResult) error
+	// GetCachedResult returns ErrNotFound unless there is an unexpired
+	// entry for the hash.
+	GetCachedResult(ctx context.Context, hash string, now time.Time) (CachedResult, error)
+	DeleteExpiredCachedResults(ctx context.Context, now time.Time) (int, error)
 }
 
+// Storage is everything the service persists. Implementations return
+// ErrNotFound for missing records and *StorageError when the backend fails.
 type Storage interface {
-	SetTask(id string, task Task)
-	GetTask(id string) (Task, bool)
-	RegisterUser(id string, username string, password string) error
-	GetUserByLogin(login string) (User, bool)
-	SetSession(session Session)
-	GetSession(SessionId string) (Session, bool)
+	UserStore
+	SessionStore
+	TaskStore
+	UsageStore
+	IdempotencyStore
+	ResultCacheStore
+	// DeleteUser removes the user together with everything they own:
+	// sessions, refresh tokens, API keys, tasks, results, usage,
+	// idempotency keys and the cached results of their tasks.
+	DeleteUser(ctx context.Context, id string) error
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
 }
 
 type InMemoryStorage struct {
-	mu       sync.RWMutex
-	tasks    map[string]Task
-	users    map[string]User
-	sessions map[string]Session
+	mu    sync.RWMutex
+	tasks map[string]Task
+	users map[string]User
+	// userLogins maps user IDs to logins, the key of users.
+	userLogins map[string]string
+	sessions   map[string]Session
+	apiKeys    map[string]APIKey
+	// apiKeyHashes maps key hashes to key IDs.
+	apiKeyHashes map[string]string
+	refresh      map[string]RefreshToken
+	usage        map[usageKey]Usage
+	idempotency  map[idempotencyKeyId]IdempotencyKey
+	resultCache  map[string]CachedResult
+}
+
+type idempotencyKeyId struct {
+	userId string
+	key    string
+}
+
+type usageKey struct {
+	userId string
+	day    string
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
-		tasks:    make(map[string]Task),
-		users:    make(map[string]User),
-		sessions: make(map[string]Session),
+		tasks:        make(map[string]Task),
+		users:        make(map[string]User),
+		userLogins:   make(map[string]string),
+		sessions:     make(map[string]Session),
+		apiKeys:      make(map[string]APIKey),
+		apiKeyHashes: make(map[string]string),
+		refresh:      make(map[string]RefreshToken),
+		usage:        make(map[usageKey]Usage),
+		idempotency:  make(map[idempotencyKeyId]IdempotencyKey),
+		resultCache:  make(map[string]CachedResult),
+	}
+}
+
+func (s *InMemoryStorage) SetTask(ctx context.Context, task Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.Id] = task
+	return nil
+}
+
+func (s *InMemoryStorage) GetTask(ctx context.Context, id string) (Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	task, exists := s.tasks[id]
+	if !exists {
+		return Task{}, ErrNotFound
+	}
+	return task, nil
+}
+
+func (s *InMemoryStorage) GetTasks(ctx context.Context) ([]Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tasks := make([]Task, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (s *InMemoryStorage) DeleteTasks(ctx context.Context, status string, createdBefore time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, task := range s.tasks {
+		if (status == "" || task.Status == status) && task.CreatedAt.Before(createdBefore) {
+			delete(s.tasks, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *InMemoryStorage) DeleteExpiredResults(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, task := range s.tasks {
+		if task.Status == "ready" && task.ResultExpired(now) {
+			if task.SourceId != "" {
+				delete(s.tasks, id)
+			} else {
+				s.tasks[id] = task.expire()
+			}
+			removed++
+		}
 	}
+	return removed, nil
+}
+
+// expire returns the task without its result, marked "expired".
+func (t Task) expire() Task {
+	t.Status = "expired"
+	t.Result = ""
+	t.ResultETag = ""
+	return t
 }
 
-func (s *InMemoryStorage) SetTask(id string, task Task) {
+func (s *InMemoryStorage) AddUsage(ctx context.Context, UserId string, at time.Time, delta Usage) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.tasks[id] = task
+	key := usageKey{userId: UserId, day: usageDay(at).Format(time.DateOnly)}
+	s.usage[key] = s.usage[key].Add(delta)
+	return nil
 }
 
-func (s *InMemoryStorage) GetTask(id string) (Task, bool) {
+func (s *InMemoryStorage) GetUsage(ctx context.Context, UserId string, from time.Time, to time.Time) (Usage, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	task, ok := s.tasks[id]
-	return task, ok
+	var total Usage
+	first, end := usageDays(from, to)
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) {
+		total = total.Add(s.usage[usageKey{userId: UserId, day: day.Format(time.DateOnly)}])
+	}
+	return total, nil
+}
+
+func (s *InMemoryStorage) ClaimIdempotencyKey(ctx context.Context, key IdempotencyKey, now time.Time) (IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := idempotencyKeyId{userId: key.UserId, key: key.Key}
+	if existing, exists := s.idempotency[id]; exists && !existing.Expired(now) {
+		return existing, nil
+	}
+	s.idempotency[id] = key
+	return key, nil
 }
 
-func (s *InMemoryStorage) RegisterUser(id string, username string, password string) error {
+func (s *InMemoryStorage) DeleteIdempotencyKey(ctx context.Context, UserId string, key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	delete(s.idempotency, idempotencyKeyId{userId: UserId, key: key})
+	return nil
+}
 
-	if _, exists := s.users[username]; exists {
-		return fmt.Errorf("user alredy exists")
+func (s *InMemoryStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, key := range s.idempotency {
+		if key.Expired(now) {
+			delete(s.idempotency, id)
+			removed++
+		}
 	}
+	return removed, nil
+}
+
+func (s *InMemoryStorage) SetCachedResult(ctx context.Context, entry CachedResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resultCache[entry.ContentHash] = entry
+	return nil
+}
+
+func (s *InMemoryStorage) GetCachedResult(ctx context.Context, hash string, now time.Time) (CachedResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, exists := s.resultCache[hash]
+	if !exists || entry.Expired(now) {
+		return CachedResult{}, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (s *InMemoryStorage) DeleteExpiredCachedResults(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for hash, entry := range s.resultCache {
+		if entry.Expired(now) {
+			delete(s.resultCache, hash)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *InMemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *InMemoryStorage) RegisterUser(ctx context.Context, id string, username string, password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return fmt.Errorf("user alredy exists")
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[username]; exists {
+		return ErrUserExists
 	}
-	s.users[username] = User{id: id, login: username, hash: string(hashedPassword)}
+	s.users[username] = User{id: id, login: username, hash: string(hashedPassword), role: RoleUser, createdAt: time.Now()}
+	s.userLogins[id] = username
 	return nil
 }
 
-func (s *InMemoryStorage) GetUserByLogin(login string) (User, bool) {
+func (s *InMemoryStorage) GetUserByLogin(ctx context.Context, login string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[login]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *InMemoryStorage) GetUserById(ctx context.Context, id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	login, exists := s.userLogins[id]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return s.users[login], nil
+}
+
+func (s *InMemoryStorage) GetUsers(ctx context.Context) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (s *InMemoryStorage) SetUserRole(ctx context.Context, id string, role string) error {
+	return s.updateUser(id, func(user *User) { user.role = role })
+}
+
+func (s *InMemoryStorage) SetUserDisabled(ctx context.Context, id string, disabled bool) error {
+	return s.updateUser(id, func(user *User) { user.disabled = disabled })
+}
+
+func (s *InMemoryStorage) SetUserPassword(ctx context.Context, id string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	return s.updateUser(id, func(user *User) { user.hash = string(hashedPassword) })
+}
+
+func (s *InMemoryStorage) DeleteUser(ctx context.Context, id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	login, exists := s.userLogins[id]
+	if !exists {
+		return ErrNotFound
+	}
+	delete(s.users, login)
+	delete(s.userLogins, id)
+	for sessionId, session := range s.sessions {
+		if session.UserId == id {
+			delete(s.sessions, sessionId)
+		}
+	}
+	for tokenId, token := range s.refresh {
+		if token.UserId == id {
+			delete(s.refresh, tokenId)
+		}
+	}
+	for keyId, key := range s.apiKeys {
+		if key.UserId == id {
+			delete(s.apiKeys, keyId)
+			delete(s.apiKeyHashes, key.Hash)
+		}
+	}
+	for taskId, task := range s.tasks {
+		if task.UserId == id {
+			delete(s.tasks, taskId)
+		}
+	}
+	for key := range s.usage {
+		if key.userId == id {
+			delete(s.usage, key)
+		}
+	}
+	for key := range s.idempotency {
+		if key.userId == id {
+			delete(s.idempotency, key)
+		}
+	}
+	for hash, entry := range s.resultCache {
+		if entry.UserId == id {
+			delete(s.resultCache, hash)
+		}
+	}
+	return nil
+}
 
-	user, exists := s.users[login]
-	return user, exists
+func (s *InMemoryStorage) updateUser(id string, update func(user *User)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, exists := s.userLogins[id]
+	if !exists {
+		return ErrNotFound
+	}
+	user := s.users[login]
+	update(&user)
+	s.users[login] = user
+	return nil
 }
 
-func (s *InMemoryStorage) SetSession(session Session) {
+func (s *InMemoryStorage) SetSession(ctx context.Context, session Session) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.sessions[session.SessionId] = session
+	return nil
+}
+
+func (s *InMemoryStorage) GetSession(ctx context.Context, SessionId string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[SessionId]
+	if !exists || session.Expired(time.Now()) {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
 }
 
-func (s *InMemoryStorage) GetSession(SessionId string) (Session, bool) {
+func (s *InMemoryStorage) TouchSession(ctx context.Context, SessionId string, now time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	session, exists := s.sessions[SessionId]
-	return session, exists
+	if !exists {
+		return ErrNotFound
+	}
+	session.LastSeenAt = now
+	s.sessions[SessionId] = session
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteSession(ctx context.Context, SessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, SessionId)
+	return nil
+}
+
+func (s *InMemoryStorage) GetUserSessions(ctx context.Context, UserId string) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.UserId == UserId && !session.Expired(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *InMemoryStorage) DeleteUserSessions(ctx context.Context, UserId string, keepSessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserId == UserId && id != keepSessionId {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *InMemoryStorage) SetAPIKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[key.Id] = key
+	s.apiKeyHashes[key.Hash] = key.Id
+	return nil
+}
+
+func (s *InMemoryStorage) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, exists := s.apiKeys[s.apiKeyHashes[hash]]
+	if !exists {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *InMemoryStorage) GetUserAPIKeys(ctx context.Context, UserId string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []APIKey
+	for _, key := range s.apiKeys {
+		if key.UserId == UserId {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *InMemoryStorage) TouchAPIKey(ctx context.Context, id string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.apiKeys[id]
+	if !exists {
+		return ErrNotFound
+	}
+	key.LastUsedAt = now
+	s.apiKeys[id] = key
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteAPIKey(ctx context.Context, UserId string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exists := s.apiKeys[id]
+	if !exists || key.UserId != UserId {
+		return ErrNotFound
+	}
+	delete(s.apiKeys, id)
+	delete(s.apiKeyHashes, key.Hash)
+	return nil
+}
+
+func (s *InMemoryStorage) SetRefreshToken(ctx context.Context, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[token.Id] = token
+	return nil
+}
+
+func (s *InMemoryStorage) GetRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, exists := s.refresh[id]
+	if !exists {
+		return RefreshToken{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (s *InMemoryStorage) RotateRefreshToken(ctx context.Context, id string, oldHash string, newHash string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, exists := s.refresh[id]
+	if !exists || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(oldHash)) != 1 {
+		return ErrNotFound
+	}
+	token.Hash = newHash
+	token.LastUsedAt = now
+	s.refresh[id] = token
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteRefreshToken(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refresh, id)
+	return nil
+}
+
+func (s *InMemoryStorage) GetUserRefreshTokens(ctx context.Context, UserId string) ([]RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var tokens []RefreshToken
+	for _, token := range s.refresh {
+		if token.UserId == UserId && !token.Expired(now) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *InMemoryStorage) DeleteUserRefreshTokens(ctx context.Context, UserId string, keepId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, token := range s.refresh {
+		if token.UserId == UserId && id != keepId {
+			delete(s.refresh, id)
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) DeleteExpiredRefreshTokens(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, token := range s.refresh {
+		if token.Expired(now) {
+			delete(s.refresh, id)
+			removed++
+		}
+	}
+	return removed, nil
 }
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testStorage runs the behaviour every Storage implementation must share.
+// newStorage must return an empty storage for each call.
+func testStorage(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("Ping", func(t *testing.T) { must(t, newStorage(t).Ping(context.Background())) })
+	t.Run("Users", func(t *testing.T) { testStorageUsers(t, newStorage(t)) })
+	t.Run("Sessions", func(t *testing.T) { testStorageSessions(t, newStorage(t)) })
+	t.Run("APIKeys", func(t *testing.T) { testStorageAPIKeys(t, newStorage(t)) })
+	t.Run("RefreshTokens", func(t *testing.T) { testStorageRefreshTokens(t, newStorage(t)) })
+	t.Run("Tasks", func(t *testing.T) { testStorageTasks(t, newStorage(t)) })
+	t.Run("ResultRetention", func(t *testing.T) { testStorageResultRetention(t, newStorage(t)) })
+	t.Run("Usage", func(t *testing.T) { testStorageUsage(t, newStorage(t)) })
+	t.Run("IdempotencyKeys", func(t *testing.T) { testStorageIdempotencyKeys(t, newStorage(t)) })
+	t.Run("ResultCache", func(t *testing.T) { testStorageResultCache(t, newStorage(t)) })
+	t.Run("DeleteUser", func(t *testing.T) { testStorageDeleteUser(t, newStorage(t)) })
+	t.Run("MissingKeys", func(t *testing.T) { testStorageMissingKeys(t, newStorage(t)) })
+	t.Run("Ownership", func(t *testing.T) { testStorageOwnership(t, newStorage(t)) })
+	t.Run("Expiry", func(t *testing.T) { testStorageExpiry(t, newStorage(t)) })
+	t.Run("ConcurrentRegistration", func(t *testing.T) { testStorageConcurrentRegistration(t, newStorage(t)) })
+	t.Run("ConcurrentRefreshRotation", func(t *testing.T) { testStorageConcurrentRefreshRotation(t, newStorage(t)) })
+	t.Run("ConcurrentSessions", func(t *testing.T) { testStorageConcurrentSessions(t, newStorage(t)) })
+	t.Run("ConcurrentTasks", func(t *testing.T) { testStorageConcurrentTasks(t, newStorage(t)) })
+	t.Run("ConcurrentIdempotencyKeys", func(t *testing.T) { testStorageConcurrentIdempotencyKeys(t, newStorage(t)) })
+}
+
+// concurrency is how many goroutines the concurrent cases start. Run the
+// tests with -race to catch unsynchronised access.
+const concurrency = 8
+
+// parallel runs fn in n goroutines at once and waits for all of them.
+func parallel(n int, fn func(i int)) {
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := range n {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			fn(i)
+		}()
+	}
+	start.Done()
+	done.Wait()
+}
+
+// testNow returns the current time at a precision every backend can store.
+func testNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// must fails the test on unexpected storage errors.
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustBeMissing fails the test unless err is ErrNotFound.
+func mustBeMissing(t *testing.T, err error, what string) {
+	t.Helper()
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("%s: got %v, want ErrNotFound", what, err)
+	}
+}
+
+func mustRegister(t *testing.T, store Storage, id string, login string) User {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.RegisterUser(ctx, id, login, "password1"); err != nil {
+		t.Fatalf("RegisterUser(%q): %v", login, err)
+	}
+	user, err := store.GetUserById(ctx, id)
+	if err != nil {
+		t.Fatalf("GetUserById(%q) after RegisterUser: %v", id, err)
+	}
+	return user
+}
+
+func testStorageUsers(t *testing.T, store Storage) {
+	ctx := context.Background()
+	user := mustRegister(t, store, "u1", "alice")
+	if user.login != "alice" || user.role != RoleUser || user.disabled {
+		t.Errorf("new user = %+v, want login alice, role user, enabled", user)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.hash), []byte("password1")) != nil {
+		t.Error("stored hash does not match the password")
+	}
+
+	if err := store.RegisterUser(ctx, "u2", "alice", "password2"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("RegisterUser with a taken login = %v, want ErrUserExists", err)
+	}
+	byLogin, err := store.GetUserByLogin(ctx, "alice")
+	must(t, err)
+	if byLogin.id != "u1" {
+		t.Errorf("GetUserByLogin(alice) = %+v", byLogin)
+	}
+	_, err = store.GetUserByLogin(ctx, "nobody")
+	mustBeMissing(t, err, "GetUserByLogin(nobody)")
+	_, err = store.GetUserById(ctx, "nobody")
+	mustBeMissing(t, err, "GetUserById(nobody)")
+
+	must(t, store.SetUserRole(ctx, "u1", RoleAdmin))
+	must(t, store.SetUserDisabled(ctx, "u1", true))
+	mustBeMissing(t, store.SetUserRole(ctx, "nobody", RoleAdmin), "SetUserRole(nobody)")
+	mustBeMissing(t, store.SetUserDisabled(ctx, "nobody", true), "SetUserDisabled(nobody)")
+	if user, _ := store.GetUserById(ctx, "u1"); user.role != RoleAdmin || !user.disabled {
+		t.Errorf("updated user = %+v, want admin and disabled", user)
+	}
+
+	must(t, store.SetUserPassword(ctx, "u1", "password2"))
+	if user, _ := store.GetUserById(ctx, "u1"); bcrypt.CompareHashAndPassword([]byte(user.hash), []byte("password2")) != nil {
+		t.Error("password was not changed")
+	}
+	mustBeMissing(t, store.SetUserPassword(ctx, "nobody", "password2"), "SetUserPassword(nobody)")
+
+	mustRegister(t, store, "u2", "bob")
+	users, err := store.GetUsers(ctx)
+	must(t, err)
+	if len(users) != 2 {
+		t.Errorf("GetUsers returned %d users, want 2", len(users))
+	}
+}
+
+func testStorageSessions(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	active := Session{
+		UserId: "u1", SessionId: "s1", CreatedAt: now, LastSeenAt: now,
+		ExpiresAt: now.Add(time.Hour), IdleTimeout: 10 * time.Minute,
+		UserAgent: "curl", RemoteAddr: "10.0.0.1",
+	}
+	must(t, store.SetSession(ctx, active))
+	must(t, store.SetSession(ctx, Session{UserId: "u1", SessionId: "s2", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetSession(ctx, Session{UserId: "u2", SessionId: "s3", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetSession(ctx, Session{UserId: "u1", SessionId: "absolute", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(-time.Second)}))
+	must(t, store.SetSession(ctx, Session{
+		UserId: "u1", SessionId: "idle", CreatedAt: now.Add(-time.Hour), LastSeenAt: now.Add(-time.Hour),
+		ExpiresAt: now.Add(time.Hour), IdleTimeout: time.Minute,
+	}))
+
+	got, err := store.GetSession(ctx, "s1")
+	must(t, err)
+	if got.UserId != "u1" || got.UserAgent != "curl" || got.RemoteAddr != "10.0.0.1" ||
+		got.IdleTimeout != active.IdleTimeout || !got.CreatedAt.Equal(now) || !got.ExpiresAt.Equal(active.ExpiresAt) {
+		t.Errorf("GetSession(s1) = %+v, want %+v", got, active)
+	}
+	for _, id := range []string{"absolute", "idle", "missing"} {
+		_, err := store.GetSession(ctx, id)
+		mustBeMissing(t, err, "GetSession("+id+")")
+	}
+
+	later := now.Add(time.Minute)
+	must(t, store.TouchSession(ctx, "s1", later))
+	if got, _ := store.GetSession(ctx, "s1"); !got.LastSeenAt.Equal(later) {
+		t.Errorf("LastSeenAt after TouchSession = %v, want %v", got.LastSeenAt, later)
+	}
+
+	sessions, err := store.GetUserSessions(ctx, "u1")
+	must(t, err)
+	if len(sessions) != 2 {
+		t.Errorf("GetUserSessions(u1) returned %d sessions, want the 2 active ones", len(sessions))
+	}
+
+	// Backends that expire sessions on their own may have nothing left to
+	// remove, but must never remove active sessions.
+	removed, err := store.DeleteExpiredSessions(ctx, now)
+	must(t, err)
+	if removed > 2 {
+		t.Errorf("DeleteExpiredSessions removed %d sessions, want at most the 2 expired ones", removed)
+	}
+	if sessions, _ := store.GetUserSessions(ctx, "u1"); len(sessions) != 2 {
+		t.Errorf("DeleteExpiredSessions left %d active sessions, want 2", len(sessions))
+	}
+
+	must(t, store.DeleteUserSessions(ctx, "u1", "s1"))
+	_, err = store.GetSession(ctx, "s2")
+	mustBeMissing(t, err, "GetSession(s2) after DeleteUserSessions")
+	if _, err := store.GetSession(ctx, "s1"); err != nil {
+		t.Errorf("DeleteUserSessions revoked the session to keep: %v", err)
+	}
+	if _, err := store.GetSession(ctx, "s3"); err != nil {
+		t.Errorf("DeleteUserSessions revoked another user's session: %v", err)
+	}
+
+	must(t, store.DeleteSession(ctx, "s1"))
+	_, err = store.GetSession(ctx, "s1")
+	mustBeMissing(t, err, "GetSession(s1) after DeleteSession")
+}
+
+func testStorageAPIKeys(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	key := APIKey{
+		Id: "k1", UserId: "u1", Name: "ci", Prefix: "ipk_abc", Hash: "hash1",
+		Scopes: []string{ScopeTasksRead, ScopeTasksWrite}, CreatedAt: now,
+	}
+	must(t, store.SetAPIKey(ctx, key))
+	must(t, store.SetAPIKey(ctx, APIKey{Id: "k2", UserId: "u1", Name: "old", Hash: "hash2", Scopes: []string{ScopeTasksRead}, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	got, err := store.GetAPIKeyByHash(ctx, "hash1")
+	must(t, err)
+	if got.Id != "k1" || got.UserId != "u1" || got.Name != "ci" || got.Prefix != "ipk_abc" ||
+		len(got.Scopes) != 2 || !got.CreatedAt.Equal(now) || !got.ExpiresAt.IsZero() || !got.LastUsedAt.IsZero() {
+		t.Errorf("GetAPIKeyByHash = %+v, want %+v", got, key)
+	}
+	_, err = store.GetAPIKeyByHash(ctx, "missing")
+	mustBeMissing(t, err, "GetAPIKeyByHash(missing)")
+
+	must(t, store.TouchAPIKey(ctx, "k1", now.Add(time.Minute)))
+	if got, _ := store.GetAPIKeyByHash(ctx, "hash1"); !got.LastUsedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("LastUsedAt after TouchAPIKey = %v", got.LastUsedAt)
+	}
+	keys, err := store.GetUserAPIKeys(ctx, "u1")
+	must(t, err)
+	if len(keys) != 2 {
+		t.Errorf("GetUserAPIKeys(u1) returned %d keys, want 2", len(keys))
+	}
+
+	mustBeMissing(t, store.DeleteAPIKey(ctx, "u2", "k1"), "DeleteAPIKey of another user's key")
+	must(t, store.DeleteAPIKey(ctx, "u1", "k1"))
+	_, err = store.GetAPIKeyByHash(ctx, "hash1")
+	mustBeMissing(t, err, "GetAPIKeyByHash after DeleteAPIKey")
+}
+
+func testStorageRefreshTokens(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r1", UserId: "u1", Hash: "h1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r2", UserId: "u1", Hash: "h2", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "expired", UserId: "u1", Hash: "h3", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(-time.Second)}))
+
+	mustBeMissing(t, store.RotateRefreshToken(ctx, "r1", "wrong", "h1b", now), "RotateRefreshToken with the wrong hash")
+	later := now.Add(time.Minute)
+	must(t, store.RotateRefreshToken(ctx, "r1", "h1", "h1b", later))
+	mustBeMissing(t, store.RotateRefreshToken(ctx, "r1", "h1", "h1c", later), "RotateRefreshToken with a rotated hash")
+	got, err := store.GetRefreshToken(ctx, "r1")
+	must(t, err)
+	if got.Hash != "h1b" || !got.LastUsedAt.Equal(later) {
+		t.Errorf("GetRefreshToken(r1) after rotation = %+v", got)
+	}
+
+	tokens, err := store.GetUserRefreshTokens(ctx, "u1")
+	must(t, err)
+	if len(tokens) != 2 {
+		t.Errorf("GetUserRefreshTokens returned %d tokens, want the 2 active ones", len(tokens))
+	}
+	removed, err := store.DeleteExpiredRefreshTokens(ctx, now)
+	must(t, err)
+	if removed != 1 {
+		t.Errorf("DeleteExpiredRefreshTokens removed %d tokens, want 1", removed)
+	}
+
+	must(t, store.DeleteUserRefreshTokens(ctx, "u1", "r1"))
+	_, err = store.GetRefreshToken(ctx, "r2")
+	mustBeMissing(t, err, "GetRefreshToken(r2) after DeleteUserRefreshTokens")
+	must(t, store.DeleteRefreshToken(ctx, "r1"))
+	_, err = store.GetRefreshToken(ctx, "r1")
+	mustBeMissing(t, err, "GetRefreshToken(r1) after DeleteRefreshToken")
+}
+
+func testStorageTasks(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+
+	task := Task{Id: "t1", UserId: "u1", FilterName: "blur", CreatedAt: now.Add(-time.Hour), Status: "in_progress", ContentHash: "c0ffee"}
+	must(t, store.SetTask(ctx, task))
+	must(t, store.SetTask(ctx, Task{Id: "t2", UserId: "u1", CreatedAt: now.Add(-time.Hour), Status: "ready", Result: "abc"}))
+	must(t, store.SetTask(ctx, Task{Id: "t3", UserId: "u1", CreatedAt: now, Status: "ready"}))
+
+	got, err := store.GetTask(ctx, "t1")
+	must(t, err)
+	if got.UserId != "u1" || got.FilterName != "blur" || got.Status != "in_progress" || !got.CreatedAt.Equal(task.CreatedAt) || got.ContentHash != "c0ffee" {
+		t.Errorf("GetTask(t1) = %+v, want %+v", got, task)
+	}
+	_, err = store.GetTask(ctx, "missing")
+	mustBeMissing(t, err, "GetTask(missing)")
+
+	task.Status = "ready"
+	task.Result = "result"
+	task.ResultETag = `"e1"`
+	must(t, store.SetTask(ctx, task))
+	if got, _ := store.GetTask(ctx, "t1"); got.Status != "ready" || got.Result != "result" || got.ResultETag != `"e1"` {
+		t.Errorf("GetTask(t1) after update = %+v", got)
+	}
+
+	tasks, err := store.GetTasks(ctx)
+	must(t, err)
+	if len(tasks) != 3 {
+		t.Errorf("GetTasks returned %d tasks, want 3", len(tasks))
+	}
+	removed, err := store.DeleteTasks(ctx, "ready", now.Add(-time.Minute))
+	must(t, err)
+	if removed != 2 {
+		t.Errorf("DeleteTasks(ready, before) removed %d tasks, want 2", removed)
+	}
+	if _, err := store.GetTask(ctx, "t3"); err != nil {
+		t.Errorf("DeleteTasks removed a task newer than the cut-off: %v", err)
+	}
+	removed, err = store.DeleteTasks(ctx, "", now.Add(time.Minute))
+	must(t, err)
+	if removed != 1 {
+		t.Errorf("DeleteTasks with no status removed %d tasks, want 1", removed)
+	}
+}
+
+func testStorageResultRetention(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+
+	expired := Task{
+		Id: "expired", UserId: "u1", CreatedAt: now.Add(-2 * time.Hour), Status: "ready", Result: "abc", ResultETag: `"e1"`,
+		ResultTTL: time.Hour, CompletedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Second),
+	}
+	must(t, store.SetTask(ctx, expired))
+	must(t, store.SetTask(ctx, Task{Id: "fresh", UserId: "u1", CreatedAt: now, Status: "ready", Result: "abc", ResultTTL: time.Hour, CompletedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetTask(ctx, Task{Id: "forever", UserId: "u1", CreatedAt: now.Add(-time.Hour), Status: "ready", Result: "abc"}))
+	must(t, store.SetTask(ctx, Task{Id: "pending", UserId: "u1", CreatedAt: now.Add(-time.Hour), Status: "in_progress", ResultTTL: time.Minute}))
+	derived := expired
+	derived.Id, derived.SourceId = "derived", "expired"
+	must(t, store.SetTask(ctx, derived))
+
+	got, err := store.GetTask(ctx, "expired")
+	must(t, err)
+	if got.ResultTTL != time.Hour || !got.CompletedAt.Equal(expired.CompletedAt) || !got.ExpiresAt.Equal(expired.ExpiresAt) {
+		t.Errorf("GetTask(expired) = %+v, want retention fields of %+v", got, expired)
+	}
+	if got, err := store.GetTask(ctx, "derived"); err != nil || got.SourceId != "expired" {
+		t.Errorf("GetTask(derived) = %+v, %v, want SourceId expired", got, err)
+	}
+
+	removed, err := store.DeleteExpiredResults(ctx, now)
+	must(t, err)
+	if removed != 2 {
+		t.Errorf("DeleteExpiredResults removed %d results, want 2", removed)
+	}
+	_, err = store.GetTask(ctx, "derived")
+	mustBeMissing(t, err, "expired derived image task")
+	got, err = store.GetTask(ctx, "expired")
+	must(t, err)
+	if got.Status != "expired" || got.Result != "" || got.ResultETag != "" || !got.ResultExpired(now) {
+		t.Errorf("task after DeleteExpiredResults = %+v, want it expired without a result", got)
+	}
+	for _, id := range []string{"fresh", "forever"} {
+		if got, _ := store.GetTask(ctx, id); got.Status != "ready" || got.Result != "abc" {
+			t.Errorf("DeleteExpiredResults touched %s: %+v", id, got)
+		}
+	}
+	if got, _ := store.GetTask(ctx, "pending"); got.Status != "in_progress" {
+		t.Errorf("DeleteExpiredResults touched a pending task: %+v", got)
+	}
+	if removed, err := store.DeleteExpiredResults(ctx, now); err != nil || removed != 0 {
+		t.Errorf("second DeleteExpiredResults = %d, %v, want 0", removed, err)
+	}
+
+	// Rewritten or deleted tasks are not expired by their old ExpiresAt.
+	must(t, store.SetTask(ctx, Task{Id: "extended", UserId: "u1", CreatedAt: now, Status: "ready", Result: "abc", ExpiresAt: now.Add(time.Minute)}))
+	must(t, store.SetTask(ctx, Task{Id: "extended", UserId: "u1", CreatedAt: now, Status: "ready", Result: "abc", ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetTask(ctx, Task{Id: "deleted", UserId: "u1", CreatedAt: now.Add(-time.Hour), Status: "ready", Result: "abc", ExpiresAt: now.Add(time.Minute)}))
+	if _, err := store.DeleteTasks(ctx, "", now); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := store.DeleteExpiredResults(ctx, now.Add(time.Minute)); err != nil || removed != 0 {
+		t.Errorf("DeleteExpiredResults after rewrite and delete = %d, %v, want 0", removed, err)
+	}
+	if got, _ := store.GetTask(ctx, "extended"); got.Status != "ready" {
+		t.Errorf("task expired by its old ExpiresAt: %+v", got)
+	}
+	_, err = store.GetTask(ctx, "deleted")
+	mustBeMissing(t, err, "deleted task after DeleteExpiredResults")
+}
+
+func testStorageUsage(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	day := time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC)
+
+	must(t, store.AddUsage(ctx, "u1", day.Add(time.Hour), Usage{Tasks: 1, InputBytes: 100}))
+	must(t, store.AddUsage(ctx, "u1", day.Add(20*time.Hour), Usage{OutputBytes: 50, CPUTime: 1500 * time.Microsecond}))
+	must(t, store.AddUsage(ctx, "u1", day.AddDate(0, 0, 1), Usage{Tasks: 2, InputBytes: 10}))
+	must(t, store.AddUsage(ctx, "u2", day, Usage{Tasks: 7}))
+
+	want := Usage{Tasks: 1, InputBytes: 100, OutputBytes: 50, CPUTime: 1500 * time.Microsecond}
+	if got, err := store.GetUsage(ctx, "u1", day, day.AddDate(0, 0, 1)); err != nil || got != want {
+		t.Errorf("GetUsage(u1, one day) = %+v, %v, want %+v", got, err, want)
+	}
+	want = Usage{Tasks: 3, InputBytes: 110, OutputBytes: 50, CPUTime: 1500 * time.Microsecond}
+	if got, err := store.GetUsage(ctx, "u1", day.AddDate(0, -1, 0), day.AddDate(0, 1, 0)); err != nil || got != want {
+		t.Errorf("GetUsage(u1, two months) = %+v, %v, want %+v", got, err, want)
+	}
+	// A range ending mid-day includes that day.
+	if got, _ := store.GetUsage(ctx, "u1", day.AddDate(0, 0, 1), day.AddDate(0, 0, 1).Add(time.Hour)); got.Tasks != 2 {
+		t.Errorf("GetUsage(u1, partial day) = %+v, want 2 tasks", got)
+	}
+	if got, _ := store.GetUsage(ctx, "u2", day, day.AddDate(0, 0, 1)); got != (Usage{Tasks: 7}) {
+		t.Errorf("GetUsage(u2) = %+v, want only u2's usage", got)
+	}
+	if got, err := store.GetUsage(ctx, "u1", day.AddDate(0, 0, 2), day.AddDate(0, 0, 3)); err != nil || got != (Usage{}) {
+		t.Errorf("GetUsage of a day without usage = %+v, %v, want zero", got, err)
+	}
+
+	must(t, store.DeleteUser(ctx, "u1"))
+	if got, _ := store.GetUsage(ctx, "u1", day, day.AddDate(0, 1, 0)); got != (Usage{}) {
+		t.Errorf("usage of a deleted user = %+v, want zero", got)
+	}
+}
+
+func testStorageIdempotencyKeys(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	first := IdempotencyKey{UserId: "u1", Key: "k", TaskId: "t1", Fingerprint: "f1", ExpiresAt: now.Add(time.Hour)}
+	if got, err := store.ClaimIdempotencyKey(ctx, first, now); err != nil || got != first {
+		t.Errorf("ClaimIdempotencyKey(new) = %+v, %v, want %+v", got, err, first)
+	}
+	retry := IdempotencyKey{UserId: "u1", Key: "k", TaskId: "t2", Fingerprint: "f2", ExpiresAt: now.Add(2 * time.Hour)}
+	if got, err := store.ClaimIdempotencyKey(ctx, retry, now); err != nil || got != first {
+		t.Errorf("ClaimIdempotencyKey(taken) = %+v, %v, want the first claim %+v", got, err, first)
+	}
+	other := IdempotencyKey{UserId: "u2", Key: "k", TaskId: "t3", ExpiresAt: now.Add(time.Hour)}
+	if got, err := store.ClaimIdempotencyKey(ctx, other, now); err != nil || got != other {
+		t.Errorf("ClaimIdempotencyKey(same key, other user) = %+v, %v, want %+v", got, err, other)
+	}
+
+	// Once expired, the key can be claimed again.
+	later := now.Add(time.Hour)
+	if got, err := store.ClaimIdempotencyKey(ctx, retry, later); err != nil || got != retry {
+		t.Errorf("ClaimIdempotencyKey(expired) = %+v, %v, want %+v", got, err, retry)
+	}
+
+	must(t, store.DeleteIdempotencyKey(ctx, "u1", "k"))
+	must(t, store.DeleteIdempotencyKey(ctx, "u1", "k"))
+	if got, err := store.ClaimIdempotencyKey(ctx, first, now); err != nil || got != first {
+		t.Errorf("ClaimIdempotencyKey(deleted) = %+v, %v, want %+v", got, err, first)
+	}
+
+	removed, err := store.DeleteExpiredIdempotencyKeys(ctx, later)
+	if err != nil || removed != 2 {
+		t.Errorf("DeleteExpiredIdempotencyKeys = %d, %v, want 2", removed, err)
+	}
+	if got, err := store.ClaimIdempotencyKey(ctx, retry, now); err != nil || got != retry {
+		t.Errorf("ClaimIdempotencyKey after cleanup = %+v, %v, want %+v", got, err, retry)
+	}
+
+	must(t, store.DeleteUser(ctx, "u1"))
+	mustRegister(t, store, "u1", "alice")
+	if got, err := store.ClaimIdempotencyKey(ctx, first, now); err != nil || got != first {
+		t.Errorf("ClaimIdempotencyKey after DeleteUser = %+v, %v, want %+v", got, err, first)
+	}
+}
+
+func testStorageResultCache(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	_, err := store.GetCachedResult(ctx, "h1", now)
+	mustBeMissing(t, err, "GetCachedResult of an unknown hash")
+
+	first := CachedResult{ContentHash: "h1", UserId: "u1", Result: "cjE=", ExpiresAt: now.Add(time.Hour)}
+	must(t, store.SetCachedResult(ctx, first))
+	if got, err := store.GetCachedResult(ctx, "h1", now); err != nil || got != first {
+		t.Errorf("GetCachedResult = %+v, %v, want %+v", got, err, first)
+	}
+	replaced := CachedResult{ContentHash: "h1", UserId: "u2", Result: "cjI=", ExpiresAt: now.Add(2 * time.Hour)}
+	must(t, store.SetCachedResult(ctx, replaced))
+	if got, err := store.GetCachedResult(ctx, "h1", now); err != nil || got != replaced {
+		t.Errorf("GetCachedResult after replace = %+v, %v, want %+v", got, err, replaced)
+	}
+
+	// Cache entries are not tasks.
+	tasks, err := store.GetTasks(ctx)
+	if err != nil || len(tasks) != 0 {
+		t.Errorf("GetTasks = %d tasks, %v, want none", len(tasks), err)
+	}
+
+	must(t, store.SetCachedResult(ctx, CachedResult{ContentHash: "h2", UserId: "u1", Result: "cjM=", ExpiresAt: now.Add(time.Hour)}))
+	later := now.Add(time.Hour)
+	_, err = store.GetCachedResult(ctx, "h2", later)
+	mustBeMissing(t, err, "expired cached result")
+	removed, err := store.DeleteExpiredCachedResults(ctx, later)
+	if err != nil || removed != 1 {
+		t.Errorf("DeleteExpiredCachedResults = %d, %v, want 1", removed, err)
+	}
+	_, err = store.GetCachedResult(ctx, "h2", now)
+	mustBeMissing(t, err, "cached result after cleanup")
+	if _, err := store.GetCachedResult(ctx, "h1", later); err != nil {
+		t.Errorf("unexpired cached result was removed: %v", err)
+	}
+
+	// A result is cached no longer than its task retains it.
+	task := completeTask(Task{Id: "t1", UserId: "u1", Status: "ready", Result: "cjQ=", ContentHash: "h3", ResultTTL: time.Hour}, now)
+	must(t, cacheResult(ctx, store, task, 24*time.Hour, now))
+	if got, err := store.GetCachedResult(ctx, "h3", now); err != nil || !got.ExpiresAt.Equal(task.ExpiresAt) {
+		t.Errorf("GetCachedResult = %+v, %v, want it to expire at %v", got, err, task.ExpiresAt)
+	}
+	_, err = store.GetCachedResult(ctx, "h3", task.ExpiresAt)
+	mustBeMissing(t, err, "cached result past its task's retention")
+	kept := completeTask(Task{Id: "t2", UserId: "u1", Status: "ready", Result: "cjU=", ContentHash: "h4"}, now)
+	must(t, cacheResult(ctx, store, kept, time.Hour, now))
+	if got, err := store.GetCachedResult(ctx, "h4", now); err != nil || !got.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("GetCachedResult of a task kept forever = %+v, %v, want it to expire at %v", got, err, now.Add(time.Hour))
+	}
+}
+
+func testStorageDeleteUser(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	for _, userId := range []string{"u1", "u2"} {
+		must(t, store.SetSession(ctx, Session{UserId: userId, SessionId: "s-" + userId, CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+		must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r-" + userId, UserId: userId, Hash: "h-" + userId, CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		must(t, store.SetAPIKey(ctx, APIKey{Id: "k-" + userId, UserId: userId, Hash: "kh-" + userId, Scopes: []string{ScopeTasksRead}, CreatedAt: now}))
+		must(t, store.SetTask(ctx, Task{Id: "t-" + userId, UserId: userId, CreatedAt: now, Status: "ready"}))
+		must(t, store.SetCachedResult(ctx, CachedResult{ContentHash: "h-" + userId, UserId: userId, ExpiresAt: now.Add(time.Hour)}))
+	}
+
+	must(t, store.DeleteUser(ctx, "u1"))
+	mustBeMissing(t, store.DeleteUser(ctx, "u1"), "second DeleteUser")
+	_, err := store.GetUserByLogin(ctx, "alice")
+	mustBeMissing(t, err, "GetUserByLogin of a deleted user")
+	_, err = store.GetSession(ctx, "s-u1")
+	mustBeMissing(t, err, "deleted user's session")
+	_, err = store.GetRefreshToken(ctx, "r-u1")
+	mustBeMissing(t, err, "deleted user's refresh token")
+	_, err = store.GetAPIKeyByHash(ctx, "kh-u1")
+	mustBeMissing(t, err, "deleted user's API key")
+	_, err = store.GetTask(ctx, "t-u1")
+	mustBeMissing(t, err, "deleted user's task")
+	_, err = store.GetCachedResult(ctx, "h-u1", now)
+	mustBeMissing(t, err, "deleted user's cached result")
+
+	if _, err := store.GetSession(ctx, "s-u2"); err != nil {
+		t.Errorf("another user's session was deleted: %v", err)
+	}
+	if _, err := store.GetTask(ctx, "t-u2"); err != nil {
+		t.Errorf("another user's task was deleted: %v", err)
+	}
+	if _, err := store.GetCachedResult(ctx, "h-u2", now); err != nil {
+		t.Errorf("another user's cached result was deleted: %v", err)
+	}
+	if err := store.RegisterUser(ctx, "u3", "alice", "password1"); err != nil {
+		t.Errorf("login of a deleted user cannot be reused: %v", err)
+	}
+}
+
+func testStorageMissingKeys(t *testing.T, store Storage) {
+	ctx := context.Background()
+	now := testNow()
+
+	mustBeMissing(t, store.TouchSession(ctx, "missing", now), "TouchSession(missing)")
+	mustBeMissing(t, store.TouchAPIKey(ctx, "missing", now), "TouchAPIKey(missing)")
+	mustBeMissing(t, store.DeleteAPIKey(ctx, "nobody", "missing"), "DeleteAPIKey(missing)")
+	mustBeMissing(t, store.RotateRefreshToken(ctx, "missing", "h", "h2", now), "RotateRefreshToken(missing)")
+	mustBeMissing(t, store.DeleteUser(ctx, "nobody"), "DeleteUser(nobody)")
+	_, err := store.GetRefreshToken(ctx, "missing")
+	mustBeMissing(t, err, "GetRefreshToken(missing)")
+
+	// Deleting what is already gone is not an error, so that logging out
+	// twice or racing the garbage collector is harmless.
+	must(t, store.DeleteSession(ctx, "missing"))
+	must(t, store.DeleteRefreshToken(ctx, "missing"))
+	must(t, store.DeleteUserSessions(ctx, "nobody", ""))
+	must(t, store.DeleteUserRefreshTokens(ctx, "nobody", ""))
+
+	if sessions, err := store.GetUserSessions(ctx, "nobody"); err != nil || len(sessions) != 0 {
+		t.Errorf("GetUserSessions(nobody) = %v, %v, want none", sessions, err)
+	}
+	if keys, err := store.GetUserAPIKeys(ctx, "nobody"); err != nil || len(keys) != 0 {
+		t.Errorf("GetUserAPIKeys(nobody) = %v, %v, want none", keys, err)
+	}
+	if tokens, err := store.GetUserRefreshTokens(ctx, "nobody"); err != nil || len(tokens) != 0 {
+		t.Errorf("GetUserRefreshTokens(nobody) = %v, %v, want none", tokens, err)
+	}
+	if users, err := store.GetUsers(ctx); err != nil || len(users) != 0 {
+		t.Errorf("GetUsers on an empty storage = %v, %v, want none", users, err)
+	}
+	if tasks, err := store.GetTasks(ctx); err != nil || len(tasks) != 0 {
+		t.Errorf("GetTasks on an empty storage = %v, %v, want none", tasks, err)
+	}
+	if removed, err := store.DeleteTasks(ctx, "", now.Add(time.Hour)); err != nil || removed != 0 {
+		t.Errorf("DeleteTasks on an empty storage = %d, %v, want 0", removed, err)
+	}
+}
+
+func testStorageOwnership(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	mustRegister(t, store, "u2", "bob")
+	now := testNow()
+
+	must(t, store.SetSession(ctx, Session{UserId: "u1", SessionId: "s1", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r1", UserId: "u1", Hash: "h1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	must(t, store.SetAPIKey(ctx, APIKey{Id: "k1", UserId: "u1", Hash: "kh1", Scopes: []string{ScopeTasksRead}, CreatedAt: now}))
+
+	if sessions, _ := store.GetUserSessions(ctx, "u2"); len(sessions) != 0 {
+		t.Errorf("GetUserSessions(u2) returned another user's sessions: %v", sessions)
+	}
+	if tokens, _ := store.GetUserRefreshTokens(ctx, "u2"); len(tokens) != 0 {
+		t.Errorf("GetUserRefreshTokens(u2) returned another user's tokens: %v", tokens)
+	}
+	if keys, _ := store.GetUserAPIKeys(ctx, "u2"); len(keys) != 0 {
+		t.Errorf("GetUserAPIKeys(u2) returned another user's keys: %v", keys)
+	}
+
+	must(t, store.DeleteUserSessions(ctx, "u2", ""))
+	must(t, store.DeleteUserRefreshTokens(ctx, "u2", ""))
+	mustBeMissing(t, store.DeleteAPIKey(ctx, "u2", "k1"), "DeleteAPIKey of another user's key")
+	if _, err := store.GetSession(ctx, "s1"); err != nil {
+		t.Errorf("DeleteUserSessions(u2) revoked u1's session: %v", err)
+	}
+	if _, err := store.GetRefreshToken(ctx, "r1"); err != nil {
+		t.Errorf("DeleteUserRefreshTokens(u2) revoked u1's token: %v", err)
+	}
+	if _, err := store.GetAPIKeyByHash(ctx, "kh1"); err != nil {
+		t.Errorf("DeleteAPIKey(u2) removed u1's key: %v", err)
+	}
+}
+
+func testStorageExpiry(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+
+	// Touching a session moves its idle deadline but not its absolute one.
+	must(t, store.SetSession(ctx, Session{
+		UserId: "u1", SessionId: "idle", CreatedAt: now.Add(-time.Hour), LastSeenAt: now.Add(-50 * time.Second),
+		ExpiresAt: now.Add(time.Hour), IdleTimeout: time.Minute,
+	}))
+	must(t, store.TouchSession(ctx, "idle", now))
+	got, err := store.GetSession(ctx, "idle")
+	must(t, err)
+	if got.Expired(now.Add(30*time.Second)) || !got.Expired(now.Add(time.Minute)) {
+		t.Errorf("session after TouchSession = %+v, want it to expire a minute from now", got)
+	}
+
+	// An expired session is gone for good even if the client keeps using it.
+	must(t, store.SetSession(ctx, Session{UserId: "u1", SessionId: "old", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(-time.Second)}))
+	if err := store.TouchSession(ctx, "old", now); err != nil && !errors.Is(err, ErrNotFound) {
+		t.Errorf("TouchSession of an expired session: %v", err)
+	}
+	_, err = store.GetSession(ctx, "old")
+	mustBeMissing(t, err, "GetSession of an expired session after TouchSession")
+
+	// Expired refresh tokens stay visible to GetRefreshToken, which the JWT
+	// authenticator relies on to tell reuse from expiry, but are not listed.
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r1", UserId: "u1", Hash: "h1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(-time.Second)}))
+	if tokens, _ := store.GetUserRefreshTokens(ctx, "u1"); len(tokens) != 0 {
+		t.Errorf("GetUserRefreshTokens listed an expired token: %v", tokens)
+	}
+	removed, err := store.DeleteExpiredRefreshTokens(ctx, now)
+	must(t, err)
+	if removed != 1 {
+		t.Errorf("DeleteExpiredRefreshTokens removed %d tokens, want 1", removed)
+	}
+	_, err = store.GetRefreshToken(ctx, "r1")
+	mustBeMissing(t, err, "GetRefreshToken after DeleteExpiredRefreshTokens")
+}
+
+func testStorageConcurrentRegistration(t *testing.T, store Storage) {
+	ctx := context.Background()
+	errs := make([]error, concurrency)
+	parallel(concurrency, func(i int) {
+		errs[i] = store.RegisterUser(ctx, fmt.Sprintf("u%d", i), "alice", "password1")
+	})
+
+	winners := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			winners++
+		case !errors.Is(err, ErrUserExists):
+			t.Errorf("concurrent RegisterUser: %v", err)
+		}
+	}
+	if winners != 1 {
+		t.Errorf("%d concurrent registrations of one login succeeded, want 1", winners)
+	}
+	users, err := store.GetUsers(ctx)
+	must(t, err)
+	if len(users) != 1 {
+		t.Errorf("GetUsers returned %d users, want 1", len(users))
+	}
+}
+
+func testStorageConcurrentRefreshRotation(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+	must(t, store.SetRefreshToken(ctx, RefreshToken{Id: "r1", UserId: "u1", Hash: "h0", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour)}))
+
+	errs := make([]error, concurrency)
+	parallel(concurrency, func(i int) {
+		errs[i] = store.RotateRefreshToken(ctx, "r1", "h0", fmt.Sprintf("h%d", i+1), now)
+	})
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner >= 0:
+			t.Errorf("refreshes %d and %d both rotated the same token", winner, i)
+		case err == nil:
+			winner = i
+		case !errors.Is(err, ErrNotFound):
+			t.Errorf("concurrent RotateRefreshToken: %v", err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no concurrent RotateRefreshToken succeeded")
+	}
+	got, err := store.GetRefreshToken(ctx, "r1")
+	must(t, err)
+	if want := fmt.Sprintf("h%d", winner+1); got.Hash != want {
+		t.Errorf("hash after rotation = %q, want the winner's %q", got.Hash, want)
+	}
+}
+
+func testStorageConcurrentSessions(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+	for i := range concurrency {
+		must(t, store.SetSession(ctx, Session{
+			UserId: "u1", SessionId: fmt.Sprintf("s%d", i), CreatedAt: now, LastSeenAt: now,
+			ExpiresAt: now.Add(time.Hour), IdleTimeout: time.Hour,
+		}))
+	}
+
+	// Requests keep touching their sessions while the user logs out
+	// everywhere; no touch may bring a revoked session back.
+	parallel(concurrency+1, func(i int) {
+		if i == concurrency {
+			if err := store.DeleteUserSessions(ctx, "u1", ""); err != nil {
+				t.Errorf("DeleteUserSessions: %v", err)
+			}
+			return
+		}
+		id := fmt.Sprintf("s%d", i)
+		for range 10 {
+			err := store.TouchSession(ctx, id, now.Add(time.Second))
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("TouchSession(%s): %v", id, err)
+				return
+			}
+			if _, err := store.GetSession(ctx, id); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetSession(%s): %v", id, err)
+				return
+			}
+		}
+	})
+
+	sessions, err := store.GetUserSessions(ctx, "u1")
+	must(t, err)
+	if len(sessions) != 0 {
+		t.Errorf("%d sessions survived DeleteUserSessions", len(sessions))
+	}
+	for i := range concurrency {
+		_, err := store.GetSession(ctx, fmt.Sprintf("s%d", i))
+		mustBeMissing(t, err, fmt.Sprintf("GetSession(s%d) after DeleteUserSessions", i))
+	}
+}
+
+func testStorageConcurrentTasks(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+	const tasksPerWriter = 10
+
+	// Writers create tasks and complete them while readers list them.
+	parallel(2*concurrency, func(i int) {
+		if i%2 == 1 {
+			for range tasksPerWriter {
+				if _, err := store.GetTasks(ctx); err != nil {
+					t.Errorf("GetTasks: %v", err)
+					return
+				}
+			}
+			return
+		}
+		for j := range tasksPerWriter {
+			task := Task{Id: fmt.Sprintf("t%d-%d", i, j), UserId: "u1", CreatedAt: now, Status: "in_progress"}
+			if err := store.SetTask(ctx, task); err != nil {
+				t.Errorf("SetTask: %v", err)
+				return
+			}
+			task.Status = "ready"
+			task.Result = task.Id
+			if err := store.SetTask(ctx, task); err != nil {
+				t.Errorf("SetTask: %v", err)
+				return
+			}
+			if got, err := store.GetTask(ctx, task.Id); err != nil || got.Status != "ready" {
+				t.Errorf("GetTask(%s) right after completing it = %+v, %v", task.Id, got, err)
+				return
+			}
+		}
+	})
+
+	tasks, err := store.GetTasks(ctx)
+	must(t, err)
+	if len(tasks) != concurrency*tasksPerWriter {
+		t.Fatalf("GetTasks returned %d tasks, want %d", len(tasks), concurrency*tasksPerWriter)
+	}
+	for _, task := range tasks {
+		if task.Status != "ready" || task.Result != task.Id {
+			t.Errorf("task %s = %+v, want it ready with its own result", task.Id, task)
+		}
+	}
+}
+
+// testStorageConcurrentIdempotencyKeys claims one key from several
+// goroutines: exactly one claim wins and everyone sees the winner.
+func testStorageConcurrentIdempotencyKeys(t *testing.T, store Storage) {
+	ctx := context.Background()
+	mustRegister(t, store, "u1", "alice")
+	now := testNow()
+
+	claimed := make([]IdempotencyKey, concurrency)
+	parallel(concurrency, func(i int) {
+		key := IdempotencyKey{UserId: "u1", Key: "k", TaskId: fmt.Sprintf("t%d", i), ExpiresAt: now.Add(time.Hour)}
+		got, err := store.ClaimIdempotencyKey(ctx, key, now)
+		if err != nil {
+			t.Errorf("ClaimIdempotencyKey: %v", err)
+		}
+		claimed[i] = got
+	})
+	for i, got := range claimed {
+		if got.TaskId == "" || got != claimed[0] {
+			t.Fatalf("claim %d returned %+v, claim 0 returned %+v; want one winner", i, got, claimed[0])
+		}
+	}
+}
+
+func TestInMemoryStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return NewInMemoryStorage()
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errInvalidToken is returned by Authenticate for credentials that are
+// malformed, unknown, expired or belong to a disabled user.
+var errInvalidToken = errors.New("invalid token")
+
+// Authenticator issues the credentials returned by /login and checks them on
+// later requests. AUTH_MODE selects between server-side sessions and signed
+// JWT access tokens backed by refresh tokens.
+type Authenticator interface {
+	Issue(user User, r *http.Request) (TokenResponse, error)
+	Authenticate(ctx context.Context, token string) (Identity, error)
+	// Revoke ends the session the identity was authenticated with.
+	Revoke(ctx context.Context, identity Identity) error
+	// RevokeOthers ends every session of the user except the current one.
+	RevokeOthers(ctx context.Context, identity Identity) error
+	Sessions(ctx context.Context, identity Identity) ([]SessionResponse, error)
+}
+
+// randomToken returns 256 random bits encoded for use in URLs and headers.
+func randomToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken returns the form in which API keys and refresh tokens are
+// stored. They carry 256 bits of randomness, so a plain SHA-256 is enough
+// and keeps lookups cheap.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type sessionAuthenticator struct {
+	users           UserStore
+	sessions        SessionStore
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+}
+
+func newSessionAuthenticator(store Storage, cfg Config) *sessionAuthenticator {
+	return &sessionAuthenticator{
+		users:           store,
+		sessions:        store,
+		idleTimeout:     cfg.SessionIdleTimeout,
+		absoluteTimeout: cfg.SessionAbsoluteTimeout,
+	}
+}
+
+func (a *sessionAuthenticator) Issue(user User, r *http.Request) (TokenResponse, error) {
+	now := time.Now()
+	session := Session{
+		UserId:      user.id,
+		SessionId:   uuid.New().String(),
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(a.absoluteTimeout),
+		IdleTimeout: a.idleTimeout,
+		UserAgent:   r.UserAgent(),
+		RemoteAddr:  clientIP(r),
+	}
+	if err := a.sessions.SetSession(r.Context(), session); err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		AccessToken: session.SessionId,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(a.absoluteTimeout / time.Second),
+		ExpiresAt:   session.ExpiresAt,
+	}, nil
+}
+
+func (a *sessionAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	session, err := a.sessions.GetSession(ctx, token)
+	if errors.Is(err, ErrNotFound) {
+		return Identity{}, errInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	user, err := a.users.GetUserById(ctx, session.UserId)
+	if errors.Is(err, ErrNotFound) || err == nil && user.disabled {
+		return Identity{}, errInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	// A failed touch only shortens the session, so it does not fail the request.
+	if err := a.sessions.TouchSession(ctx, session.SessionId, time.Now()); err != nil {
+		loggerFromContext(ctx).Error("Failed to touch session", "error", err)
+	}
+	return Identity{UserId: user.id, Role: user.role, SessionId: session.SessionId}, nil
+}
+
+func (a *sessionAuthenticator) Revoke(ctx context.Context, identity Identity) error {
+	return a.sessions.DeleteSession(ctx, identity.SessionId)
+}
+
+func (a *sessionAuthenticator) RevokeOthers(ctx context.Context, identity Identity) error {
+	return a.sessions.DeleteUserSessions(ctx, identity.UserId, identity.SessionId)
+}
+
+func (a *sessionAuthenticator) Sessions(ctx context.Context, identity Identity) ([]SessionResponse, error) {
+	sessions, err := a.sessions.GetUserSessions(ctx, identity.UserId)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionResponse{
+			Current:    session.SessionId == identity.SessionId,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			RemoteAddr: session.RemoteAddr,
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// UploadLimits bound what POST /task accepts. MaxPixels protects the worker
+// from decompression bombs: small files that decode to huge images.
+type UploadLimits struct {
+	MaxBytes  int64
+	MaxPixels int64
+}
+
+// uploadFormOverhead is room for the multipart framing and the other form
+// fields on top of the image itself.
+const uploadFormOverhead = 64 << 10
+
+// uploadContentTypes are the sniffed types the worker can decode.
+var uploadContentTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+// uploadError is a rejected upload and the status to answer with.
+type uploadError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// readUpload reads the "image" file of a multipart request and checks its
+// size, type and dimensions. Only the image header is decoded. Rejections
+// are returned as *uploadError.
+func readUpload(w http.ResponseWriter, r *http.Request, limits UploadLimits) ([]byte, error) {
+	tooLarge := &uploadError{http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("Image must not exceed %d bytes", limits.MaxBytes)}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBytes+uploadFormOverhead)
+	if err := r.ParseMultipartForm(limits.MaxBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, tooLarge
+		}
+		return nil, &uploadError{http.StatusBadRequest, "invalid_request", "Invalid multipart form"}
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "invalid_request", "Missing image file"}
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, limits.MaxBytes+1))
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "invalid_image", "Failed to read image file"}
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, tooLarge
+	}
+
+	// The client's Content-Type is not trusted; look at the bytes.
+	if contentType := http.DetectContentType(data); !slices.Contains(uploadContentTypes, contentType) {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "unsupported_media_type", "Unsupported image type " + contentType}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return nil, &uploadError{http.StatusBadRequest, "invalid_image", "Invalid image"}
+	}
+	if pixels := int64(config.Width) * int64(config.Height); limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "image_too_many_pixels",
+			fmt.Sprintf("Image is %dx%d, more than %d pixels", config.Width, config.Height, limits.MaxPixels)}
+	}
+	return data, nil
+}
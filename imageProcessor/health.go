@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// healthCheckTimeout bounds each dependency check of /readyz.
+const healthCheckTimeout = 2 * time.Second
+
+// consumerState tracks the consumer loop for the health checks.
+type consumerState struct {
+	mu        sync.Mutex
+	consuming bool
+	// busySince is when the message being handled was received, or zero
+	// between messages.
+	busySince time.Time
+}
+
+func (s *consumerState) setConsuming(consuming bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consuming = consuming
+}
+
+func (s *consumerState) setBusy(busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if busy {
+		s.busySince = time.Now()
+	} else {
+		s.busySince = time.Time{}
+	}
+}
+
+// check fails if the consumer has stopped or has been stuck on one message
+// for longer than stuckAfter.
+func (s *consumerState) check(stuckAfter time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case !s.consuming:
+		return errors.New("not consuming")
+	case !s.busySince.IsZero() && time.Since(s.busySince) > stuckAfter:
+		return fmt.Errorf("stuck on a message for %s", time.Since(s.busySince).Round(time.Second))
+	default:
+		return nil
+	}
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	// Checks maps each dependency to "ok" or "unavailable". Reasons are
+	// only logged, as they may reveal internal addresses.
+	Checks map[string]string `json:"checks"`
+}
+
+// healthHandler answers 200 if all checks pass and 503 otherwise.
+func healthHandler(checks map[string]func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := healthResponse{Status: "ok", Checks: make(map[string]string, len(checks))}
+		for name, check := range checks {
+			ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+			err := check(ctx)
+			cancel()
+			if err != nil {
+				slog.Warn("Health check failed", "check", name, "error", err)
+				response.Status = "unavailable"
+				response.Checks[name] = "unavailable"
+			} else {
+				response.Checks[name] = "ok"
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if response.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// publisherCheck fails unless the HTTP service, which results are committed
+// to, reports itself ready: a commit needs both its storage and its broker.
+func publisherCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publisherURL+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// serveHTTP exposes /metrics, /healthz and /readyz on HTTP_ADDR, :9100 by
+// default. /healthz fails when a restart is needed: the broker connection
+// is gone, the consumer stopped or a message has been processing for longer
+// than STUCK_AFTER (5m by default). /readyz also checks that the HTTP
+// service is ready.
+func serveHTTP(conn *amqp.Connection, state *consumerState) {
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		addr = ":9100"
+	}
+	stuckAfter := 5 * time.Minute
+	if value := os.Getenv("STUCK_AFTER"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		failOnError(err, "Invalid STUCK_AFTER")
+		stuckAfter = parsed
+	}
+
+	broker := func(ctx context.Context) error {
+		if conn.IsClosed() {
+			return errors.New("connection closed")
+		}
+		return nil
+	}
+	consumer := func(ctx context.Context) error {
+		return state.check(stuckAfter)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(map[string]func(ctx context.Context) error{
+		"broker":   broker,
+		"consumer": consumer,
+	}))
+	mux.Handle("/readyz", healthHandler(map[string]func(ctx context.Context) error{
+		"broker":    broker,
+		"consumer":  consumer,
+		"publisher": publisherCheck,
+	}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("HTTP listener stopped", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePublisher points publisherURL at handler for the duration of the test.
+func usePublisher(t *testing.T, handler http.Handler) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	saved := publisherURL
+	publisherURL = server.URL
+	t.Cleanup(func() {
+		publisherURL = saved
+		server.Close()
+	})
+}
+
+func TestConsumerStateCheck(t *testing.T) {
+	var state consumerState
+	if err := state.check(time.Minute); err == nil {
+		t.Error("check passed before consuming")
+	}
+	state.setConsuming(true)
+	if err := state.check(time.Minute); err != nil {
+		t.Errorf("idle consumer: %v", err)
+	}
+	state.setBusy(true)
+	if err := state.check(time.Minute); err != nil {
+		t.Errorf("consumer busy for less than stuckAfter: %v", err)
+	}
+	state.busySince = time.Now().Add(-2 * time.Minute)
+	if err := state.check(time.Minute); err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Errorf("consumer busy for longer than stuckAfter: %v, want stuck", err)
+	}
+	state.setBusy(false)
+	if err := state.check(time.Minute); err != nil {
+		t.Errorf("consumer done with the message: %v", err)
+	}
+	state.setConsuming(false)
+	if err := state.check(time.Minute); err == nil {
+		t.Error("check passed after the consumer stopped")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("dial tcp 10.0.0.7:8080: connection refused") }
+	tests := []struct {
+		name   string
+		checks map[string]func(ctx context.Context) error
+		status int
+		want   healthResponse
+	}{
+		{
+			name:   "all ok",
+			checks: map[string]func(ctx context.Context) error{"broker": ok, "consumer": ok},
+			status: http.StatusOK,
+			want:   healthResponse{Status: "ok", Checks: map[string]string{"broker": "ok", "consumer": "ok"}},
+		},
+		{
+			name:   "one failing",
+			checks: map[string]func(ctx context.Context) error{"broker": ok, "publisher": failing},
+			status: http.StatusServiceUnavailable,
+			want:   healthResponse{Status: "unavailable", Checks: map[string]string{"broker": "ok", "publisher": "unavailable"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			healthHandler(tt.checks).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if strings.Contains(w.Body.String(), "10.0.0.7") {
+				t.Errorf("response reveals the failure reason: %s", w.Body)
+			}
+			var got healthResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want.Status || len(got.Checks) != len(tt.want.Checks) {
+				t.Fatalf("response %+v, want %+v", got, tt.want)
+			}
+			for name, status := range tt.want.Checks {
+				if got.Checks[name] != status {
+					t.Errorf("check %s = %q, want %q", name, got.Checks[name], status)
+				}
+			}
+		})
+	}
+}
+
+func TestPublisherCheck(t *testing.T) {
+	status := http.StatusOK
+	var path string
+	usePublisher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(status)
+	}))
+
+	if err := publisherCheck(context.Background()); err != nil {
+		t.Errorf("ready publisher: %v", err)
+	}
+	if path != "/readyz" {
+		t.Errorf("checked %s, want /readyz", path)
+	}
+	status = http.StatusServiceUnavailable
+	if err := publisherCheck(context.Background()); err == nil {
+		t.Error("check passed for a publisher that is not ready")
+	}
+}
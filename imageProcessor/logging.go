@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// requestIDHeader carries the ID of the HTTP request that queued a task, in
+// the AMQP message and back in the commit request.
+const requestIDHeader = "X-Request-ID"
+
+// setupLogging makes slog write JSON lines to stdout at the level set by
+// LOG_LEVEL ("debug", "info", "warn" or "error"; "info" by default).
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+// requestIDFromHeaders returns the request ID of a message, or "" if it has
+// none.
+func requestIDFromHeaders(headers amqp.Table) string {
+	id, _ := headers[requestIDHeader].(string)
+	return id
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRequestIDFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    string
+	}{
+		{"set", amqp.Table{requestIDHeader: "req-42"}, "req-42"},
+		{"missing", amqp.Table{}, ""},
+		{"no headers", nil, ""},
+		{"not a string", amqp.Table{requestIDHeader: int32(42)}, ""},
+	}
+	for _, tt := range tests {
+		if got := requestIDFromHeaders(tt.headers); got != tt.want {
+			t.Errorf("%s: requestIDFromHeaders = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+type commitRequest struct {
+	requestID     string
+	authorization string
+	body          map[string]any
+}
+
+// TestHandleMessageCommits processes messages against a fake publisher and
+// checks that each commit carries the request ID that queued the task.
+func TestHandleMessageCommits(t *testing.T) {
+	var commits []commitRequest
+	usePublisher(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/Commit" {
+			http.NotFound(w, r)
+			return
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		commits = append(commits, commitRequest{r.Header.Get(requestIDHeader), r.Header.Get("Authorization"), body})
+	}))
+	savedToken := workerToken
+	workerToken = "worker-secret"
+	t.Cleanup(func() { workerToken = savedToken })
+
+	var input bytes.Buffer
+	if err := png.Encode(&input, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	message := func(taskID, filter string) []byte {
+		body, err := json.Marshal(ImageFilterMessage{TaskId: taskID, ImageBase64: base64.StdEncoding.EncodeToString(input.Bytes()), FilterName: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	handleMessage(message("t1", "blur"), "req-42")
+	handleMessage(message("t2", "sharpen"), "")
+	handleMessage([]byte("not json"), "req-43")
+
+	if len(commits) != 2 {
+		t.Fatalf("%d commits, want 2: a malformed message has no task to commit", len(commits))
+	}
+	ready, failed := commits[0], commits[1]
+	if ready.requestID != "req-42" || failed.requestID != "" {
+		t.Errorf("commit request IDs %q and %q, want req-42 and none", ready.requestID, failed.requestID)
+	}
+	if ready.authorization != "Bearer worker-secret" {
+		t.Errorf("Authorization = %q, want the worker token", ready.authorization)
+	}
+	if ready.body["id"] != "t1" || ready.body["status"] != "ready" {
+		t.Errorf("commit %v, want t1 ready", ready.body)
+	}
+	result, err := base64.StdEncoding.DecodeString(ready.body["result"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(result)); err != nil {
+		t.Errorf("result is not a PNG: %v", err)
+	}
+	if failed.body["id"] != "t2" || failed.body["status"] != "failed" || failed.body["result"] != "" {
+		t.Errorf("commit %v, want t2 failed without a result", failed.body)
+	}
+}
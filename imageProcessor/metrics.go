@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// imageSizeBuckets go from 1 KiB to 64 MiB.
+var imageSizeBuckets = prometheus.ExponentialBuckets(1024, 4, 9)
+
+var (
+	messagesConsumedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imageprocessor_messages_consumed_total",
+		Help: "Messages taken from the task queue.",
+	})
+	processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imageprocessor_processing_duration_seconds",
+		Help:    "Time spent decoding, filtering and encoding an image, by filter pipeline.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"filter"})
+	failuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imageprocessor_failures_total",
+		Help: "Failed messages by stage: decode (malformed message), process or commit.",
+	}, []string{"stage", "filter"})
+	inputImageBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imageprocessor_input_image_bytes",
+		Help:    "Size of the images received.",
+		Buckets: imageSizeBuckets,
+	})
+	outputImageBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "imageprocessor_output_image_bytes",
+		Help:    "Size of the processed images.",
+		Buckets: imageSizeBuckets,
+	})
+)
+
+// filterLabel returns the pipeline as a label value if all of its filters
+// exist, and "unknown" otherwise, so that bad messages cannot create
+// arbitrary series.
+func filterLabel(pipeline string) string {
+	for _, name := range strings.Split(pipeline, ",") {
+		if _, ok := filters[name]; !ok {
+			return "unknown"
+		}
+	}
+	return pipeline
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestFilterLabel(t *testing.T) {
+	tests := []struct {
+		pipeline string
+		want     string
+	}{
+		{"blur", "blur"},
+		{"blur,blur", "blur,blur"},
+		{"sharpen", "unknown"},
+		{"blur,sharpen", "unknown"},
+		{"Blur", "unknown"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := filterLabel(tt.pipeline); got != tt.want {
+			t.Errorf("filterLabel(%q) = %q, want %q", tt.pipeline, got, tt.want)
+		}
+	}
+}